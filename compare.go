@@ -0,0 +1,184 @@
+package mapreduce
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// A Comparator orders two keys or values, returning a negative number, zero
+// or a positive number as a sorts before, the same as or after b.
+type Comparator func(a, b string) int
+
+// SortSpec names the comparators a job's reduce tasks use. Empty names mean
+// bytewise order. Keys are sorted by Keys, and the values of a key by
+// Values. Runs of sorted keys that Group says are the same go to a single
+// Reduce call, under the first of them; Group defaults to Keys. Sorting on
+// a composite key and grouping on part of it gives a secondary sort.
+type SortSpec struct {
+	Keys   string
+	Values string
+	Group  string
+}
+
+var comparators = struct {
+	sync.Mutex
+	byName map[string]Comparator
+}{byName: map[string]Comparator{
+	"bytes":   strings.Compare,
+	"reverse": func(a, b string) int { return strings.Compare(b, a) },
+	"nocase":  func(a, b string) int { return strings.Compare(strings.ToLower(a), strings.ToLower(b)) },
+	"numeric": compareNumeric,
+}}
+
+// RegisterComparator makes a comparator available to jobs by name. The
+// master only checks that a job's comparators exist; the reduce workers
+// sort with them, so they need the real thing.
+func RegisterComparator(name string, cmp Comparator) {
+	comparators.Lock()
+	defer comparators.Unlock()
+	comparators.byName[name] = cmp
+}
+
+// comparator looks up a comparator by name.
+func comparator(name string) (Comparator, error) {
+	if name == "" {
+		name = "bytes"
+	}
+	comparators.Lock()
+	cmp, ok := comparators.byName[name]
+	comparators.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no comparator named %q", name)
+	}
+	return cmp, nil
+}
+
+// check makes sure every comparator the spec names exists.
+func (spec SortSpec) check() error {
+	for _, name := range []string{spec.Keys, spec.Values, spec.Group} {
+		if _, err := comparator(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grouping returns the comparator that decides which keys share a Reduce
+// call.
+func (spec SortSpec) grouping() (Comparator, error) {
+	if spec.Group == "" {
+		return comparator(spec.Keys)
+	}
+	return comparator(spec.Group)
+}
+
+// compareNumeric orders numbers by value, ahead of anything that is not a
+// number, which is ordered bytewise.
+func compareNumeric(a, b string) int {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	switch {
+	case errA == nil && errB == nil:
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// guardedComparator runs a comparator, recovering from a panic in it rather
+// than letting it take down the worker. A comparison that panics counts as
+// equal, and the first panic is kept to be returned by err.
+type guardedComparator struct {
+	cmp      Comparator
+	panicked error
+}
+
+func guard(cmp Comparator) *guardedComparator {
+	return &guardedComparator{cmp: cmp}
+}
+
+func (g *guardedComparator) compare(a, b string) int {
+	n := 0
+	err := protect(func() error {
+		n = g.cmp(a, b)
+		return nil
+	})
+	if err != nil && g.panicked == nil {
+		g.panicked = err
+	}
+	return n
+}
+
+func (g *guardedComparator) err() error {
+	return g.panicked
+}
+
+// querySorted reads the pairs of db ordered as spec says. The comparators
+// are registered with SQLite as collations on the connection used for the
+// query, which is released by the returned function once the rows are done.
+// It also reports a panic in either comparator, in which case the rows were
+// not properly sorted.
+func querySorted(ctx context.Context, db *sql.DB, spec SortSpec) (*sql.Rows, func() error, error) {
+	if (spec.Keys == "" || spec.Keys == "bytes") && (spec.Values == "" || spec.Values == "bytes") {
+		rows, err := db.QueryContext(ctx, "select key, value from pairs order by key, value")
+		return rows, func() error { return nil }, err
+	}
+
+	keyCmp, err := comparator(spec.Keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	valueCmp, err := comparator(spec.Values)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, values := guard(keyCmp), guard(valueCmp)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("not a sqlite3 connection")
+		}
+		if err := c.RegisterCollation("mr_key", keys.compare); err != nil {
+			return err
+		}
+		return c.RegisterCollation("mr_value", values.compare)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	rows, err := conn.QueryContext(ctx, "select key, value from pairs order by key collate mr_key, value collate mr_value")
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	release := func() error {
+		conn.Close()
+		if err := keys.err(); err != nil {
+			return fmt.Errorf("key comparator %q: %v", spec.Keys, err)
+		}
+		if err := values.err(); err != nil {
+			return fmt.Errorf("value comparator %q: %v", spec.Values, err)
+		}
+		return nil
+	}
+	return rows, release, nil
+}
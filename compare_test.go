@@ -0,0 +1,157 @@
+package mapreduce
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompareNumeric(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2", "10", -1},
+		{"10", "2", 1},
+		{"1.5", "1.50", 0},
+		{"-3", "2", -1},
+		{"1e3", "999", 1},
+		{"7", "apple", -1},
+		{"apple", "7", 1},
+		{"apple", "banana", -1},
+		{"pear", "pear", 0},
+	}
+	for _, test := range tests {
+		if got := compareNumeric(test.a, test.b); sign(got) != test.want {
+			t.Errorf("compareNumeric(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+func TestQuerySorted(t *testing.T) {
+	pairs := []Pair{
+		{"10", "b"}, {"9", "a"}, {"Apple", "x"}, {"apple", "y"}, {"10", "a"}, {"banana", "z"},
+	}
+	tests := []struct {
+		spec SortSpec
+		want []Pair
+	}{
+		{SortSpec{}, []Pair{
+			{"10", "a"}, {"10", "b"}, {"9", "a"}, {"Apple", "x"}, {"apple", "y"}, {"banana", "z"},
+		}},
+		{SortSpec{Keys: "numeric"}, []Pair{
+			{"9", "a"}, {"10", "a"}, {"10", "b"}, {"Apple", "x"}, {"apple", "y"}, {"banana", "z"},
+		}},
+		{SortSpec{Keys: "reverse", Values: "reverse"}, []Pair{
+			{"banana", "z"}, {"apple", "y"}, {"Apple", "x"}, {"9", "a"}, {"10", "b"}, {"10", "a"},
+		}},
+		{SortSpec{Keys: "bytes", Values: "reverse"}, []Pair{
+			{"10", "b"}, {"10", "a"}, {"9", "a"}, {"Apple", "x"}, {"apple", "y"}, {"banana", "z"},
+		}},
+	}
+
+	db, err := createDatabase(filepath.Join(t.TempDir(), "pairs.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, pair := range pairs {
+		if err = insertPair(db, pair); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range tests {
+		got, err := readSorted(db, test.spec)
+		if err != nil {
+			t.Errorf("querySorted(%+v): %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("querySorted(%+v) = %v, want %v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestQuerySortedPanic(t *testing.T) {
+	RegisterComparator("test-panic", func(a, b string) int { panic("boom") })
+
+	db, err := createDatabase(filepath.Join(t.TempDir(), "pairs.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"b", "a", "c"} {
+		if err = insertPair(db, Pair{Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = readSorted(db, SortSpec{Keys: "test-panic"}); err == nil {
+		t.Errorf("querySorted with a panicking comparator succeeded")
+	}
+}
+
+// readSorted returns every pair of db in the order querySorted gives them.
+func readSorted(db *sql.DB, spec SortSpec) ([]Pair, error) {
+	rows, release, err := querySorted(context.Background(), db, spec)
+	if err != nil {
+		return nil, err
+	}
+	var pairs []Pair
+	for rows.Next() {
+		var pair Pair
+		if err = rows.Scan(&pair.Key, &pair.Value); err != nil {
+			rows.Close()
+			release()
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		release()
+		return nil, err
+	}
+	return pairs, release()
+}
+
+func TestGrouping(t *testing.T) {
+	tests := []struct {
+		spec SortSpec
+		a, b string
+		same bool
+	}{
+		{SortSpec{}, "Apple", "apple", false},
+		{SortSpec{Keys: "nocase"}, "Apple", "apple", true},
+		{SortSpec{Keys: "bytes", Group: "nocase"}, "Apple", "apple", true},
+		{SortSpec{Keys: "numeric"}, "1.0", "1", true},
+		{SortSpec{Keys: "numeric", Group: "bytes"}, "1.0", "1", false},
+	}
+	for _, test := range tests {
+		group, err := test.spec.grouping()
+		if err != nil {
+			t.Errorf("%+v.grouping(): %v", test.spec, err)
+			continue
+		}
+		if same := group(test.a, test.b) == 0; same != test.same {
+			t.Errorf("%+v groups %q with %q: %v, want %v", test.spec, test.a, test.b, same, test.same)
+		}
+	}
+
+	if _, err := (SortSpec{Group: "no-such-comparator"}).grouping(); err == nil {
+		t.Errorf("grouping with an unknown comparator succeeded")
+	}
+}
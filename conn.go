@@ -0,0 +1,93 @@
+package mapreduce
+
+import (
+	"log"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// masterConn is a worker's connection to the master. It is shared by the
+// task loop and the heartbeat, and dialed again if it drops.
+type masterConn struct {
+	address string
+	mu      sync.Mutex
+	client  *rpc.Client
+}
+
+func newMasterConn(address string) *masterConn {
+	return &masterConn{address: address}
+}
+
+// get returns the open connection, dialing the master if there is none.
+// If retry is set it keeps trying for up to masterRetry in case the master
+// is being restarted.
+func (c *masterConn) get(retry bool) (*rpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	var err error
+	for start := time.Now(); ; time.Sleep(time.Second) {
+		c.client, err = rpc.DialHTTP("tcp", c.address)
+		if err == nil {
+			return c.client, nil
+		}
+		if !retry || time.Since(start) > masterRetry {
+			return nil, err
+		}
+		log.Printf("rpc.DialHTTP: %v, retrying", err)
+	}
+}
+
+// drop forgets a broken connection so that the next call dials again.
+func (c *masterConn) drop(client *rpc.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == client {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+// call makes an RPC to the master, reconnecting once if the connection has
+// gone away.
+func (c *masterConn) call(method string, args interface{}, reply interface{}) error {
+	return c.do(true, method, args, reply)
+}
+
+// try is like call, but gives up straight away if the master cannot be
+// reached.
+func (c *masterConn) try(method string, args interface{}, reply interface{}) error {
+	return c.do(false, method, args, reply)
+}
+
+func (c *masterConn) do(retry bool, method string, args interface{}, reply interface{}) error {
+	for tries := 0; ; tries++ {
+		client, err := c.get(retry)
+		if err != nil {
+			return err
+		}
+		err = client.Call(method, args, reply)
+		if _, ok := err.(rpc.ServerError); err == nil || ok {
+			return err
+		}
+		// the connection itself failed
+		c.drop(client)
+		if tries > 0 {
+			return err
+		}
+	}
+}
+
+// close closes the connection, if there is one.
+func (c *masterConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
@@ -1,12 +1,16 @@
 package mapreduce
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -79,62 +83,79 @@ func createDatabase(path string) (*sql.DB, error) {
 	return db, nil
 }
 
-func splitDatabase(source, outputPattern string, m int) ([]string, error) {
-	// example call: paths, err := splitDatabase("input.sqlite3", "output-%d.sqlite3", 50)
+// splitDatabase deals the pairs of source out between m new databases named
+// by outputPattern. It also returns a random sample of up to samples of the
+// source's keys, sorted.
+func splitDatabase(source, outputPattern string, m int, samples int) ([]string, []string, error) {
+	// example call: paths, sample, err := splitDatabase("input.sqlite3", "output-%d.sqlite3", 50, 0)
 
 	var partitionNames []string
 	var partitions []*sql.DB
+	defer func() {
+		for _, partition := range partitions {
+			partition.Close()
+		}
+	}()
 
 	//opening source
+	if _, err := os.Stat(source); err != nil {
+		return nil, nil, err
+	}
 	db, err := openDatabase(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer db.Close()
 
 	for i := 0; i < m; i++ {
 		path := fmt.Sprintf(outputPattern, i)
 		partitionNames = append(partitionNames, path)
 		partition, err := createDatabase(path)
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, err
 		}
 		partitions = append(partitions, partition)
 	}
 
 	//figure out how many pairs should be in each partition
-	stmt, err := db.Prepare("select count(1) from pairs")
-	if err != nil {
-		return nil, err
-	}
 	var nPairs int
-	err = stmt.QueryRow().Scan(&nPairs)
+	err = db.QueryRow("select count(1) from pairs").Scan(&nPairs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if nPairs < m {
-		log.Fatal("you must request fewer partitions than rows, (split database)")
+		return nil, nil, fmt.Errorf("you must request fewer partitions than rows, %d rows and %d partitions", nPairs, m)
 	}
 
 	//insert rows into partitions
 	rows, err := db.Query("select key, value from pairs")
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
+	defer rows.Close()
 
-	var key string
-	var value string
+	var pair Pair
+	var sample []string
+	seen := 0
 	j := 0
 	for rows.Next() {
-		err = rows.Scan(&key, &value)
-		dbIN := partitions[j]
-
-		tx, err := dbIN.Begin()
+		err = rows.Scan(&pair.Key, &pair.Value)
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, err
 		}
-		_, err = tx.Exec("insert into pairs(key, value) values(?, ?)", key, value)
-		if err != nil {
-			log.Fatal(err)
+
+		// reservoir sampling: every key seen so far has the same chance of
+		// being in the sample
+		seen++
+		if len(sample) < samples {
+			sample = append(sample, pair.Key)
+		} else if i := rand.Intn(seen); i < samples {
+			sample[i] = pair.Key
+		}
+		if err = insertPair(partitions[j], pair); err != nil {
+			return nil, nil, err
 		}
-		tx.Commit()
 
 		if j >= m-1 {
 			j = 0
@@ -142,51 +163,114 @@ func splitDatabase(source, outputPattern string, m int) ([]string, error) {
 			j++
 		}
 	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
 
-	stmt.Close()
-	return partitionNames, nil
+	sort.Strings(sample)
+	return partitionNames, sample, nil
 }
 
-func mergeDatabases(urls []string, path string, temp string) (*sql.DB, error) {
+// fetchError reports the urls that could not be downloaded by mergeDatabases.
+type fetchError struct {
+	urls []string
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("failed to fetch %s", strings.Join(e.urls, ", "))
+}
+
+// mergeDatabases gathers the databases at urls into a new database at path,
+// using temp for each one in turn. Urls served by self are copied from disk
+// instead of downloaded. The bytes read are added to counters. Urls that
+// can't be fetched are reported together in a *fetchError; on any error the
+// new database is closed and nil returned.
+func mergeDatabases(ctx context.Context, urls []string, path string, temp string, self string, counters *taskCounters) (*sql.DB, error) {
 	db, err := createDatabase(path)
 	if err != nil {
-		log.Fatal(err)
+		if db != nil {
+			db.Close()
+		}
+		return nil, fmt.Errorf("creating %s: %v", path, err)
 	}
 
+	var failed []string
 	for _, url := range urls {
-		err = download(url, temp)
+		n, local, err := fetch(ctx, url, temp, self)
+		counters.add(n, local)
 		if err != nil {
-			log.Printf("download failed, path: %v", path)
+			log.Printf("download failed, url: %v: %v", url, err)
+			failed = append(failed, url)
+			continue
 		}
 		err = gatherInto(db, temp)
+		os.Remove(temp)
 		if err != nil {
-			log.Printf("gatherinto failed, path: %v", path)
+			db.Close()
+			return nil, fmt.Errorf("merging %s: %v", url, err)
 		}
-		os.Remove(temp)
+	}
+	if len(failed) > 0 {
+		db.Close()
+		return nil, &fetchError{urls: failed}
 	}
 	return db, nil
 }
 
-func download(url, path string) error {
+// fetch copies the file at url to path, reading it straight from disk if
+// the url is served by self, this host. It returns the number of bytes read
+// and whether they were local.
+func fetch(ctx context.Context, url, path, self string) (int64, bool, error) {
+	if self != "" && urlHost(url) == self {
+		n, err := copyFile(strings.TrimPrefix(url, "http://"+self), path)
+		return n, true, err
+	}
+	n, err := download(ctx, url, path)
+	return n, false, err
+}
+
+func download(ctx context.Context, url, path string) (int64, error) {
 	log.Printf("downloading database from: %v, saving to: %v", url, path)
 
-	res, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("get %s: %s", url, res.Status)
+	}
 
 	tempFile, err := os.Create(path)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer tempFile.Close()
 
-	_, err = io.Copy(tempFile, res.Body)
+	return io.Copy(tempFile, res.Body)
+}
+
+// copyFile copies a local file from src to dst.
+func copyFile(src, dst string) (int64, error) {
+	log.Printf("copying local database from: %v, saving to: %v", src, dst)
+
+	in, err := os.Open(src)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	return io.Copy(out, in)
 }
 
 func gatherInto(db *sql.DB, path string) error {
@@ -200,7 +284,7 @@ func gatherInto(db *sql.DB, path string) error {
 	}
 
 	sqlStmt = `
-	insert into pairs select * from merge.pairs
+	insert into pairs select * from merge.pairs order by rowid
 	`
 	_, err = db.Exec(sqlStmt)
 	if err != nil {
@@ -221,11 +305,27 @@ func gatherInto(db *sql.DB, path string) error {
 	return nil
 }
 
-func mapSourceFile(m int) string       { return fmt.Sprintf("map_%d_source.sqlite3", m) }
-func mapInputFile(m int) string        { return fmt.Sprintf("map_%d_input.sqlite3", m) }
-func mapOutputFile(m, r int) string    { return fmt.Sprintf("map_%d_output_%d.sqlite3", m, r) }
-func reduceInputFile(r int) string     { return fmt.Sprintf("reduce_%d_input.sqlite3", r) }
-func reduceOutputFile(r int) string    { return fmt.Sprintf("reduce_%d_output.sqlite3", r) }
-func reducePartialFile(r int) string   { return fmt.Sprintf("reduce_%d_partial.sqlite3", r) }
-func reduceTempFile(r int) string      { return fmt.Sprintf("reduce_%d_temp.sqlite3", r) }
-func makeURL(host, file string) string { return fmt.Sprintf("http://%s/data/%s", host, file) }
+func insertPair(db *sql.DB, pair Pair) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into pairs(key, value) values(?, ?)", pair.Key, pair.Value)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func mapSourceFile(m int) string          { return fmt.Sprintf("map_%d_source.sqlite3", m) }
+func mapInputFile(m int) string           { return fmt.Sprintf("map_%d_input.sqlite3", m) }
+func mapOutputFile(m, r int) string       { return fmt.Sprintf("map_%d_output_%d.sqlite3", m, r) }
+func mapUncombinedFile(m, r int) string   { return fmt.Sprintf("map_%d_uncombined_%d.sqlite3", m, r) }
+func reduceInputFile(r int) string        { return fmt.Sprintf("reduce_%d_input.sqlite3", r) }
+func reduceOutputFile(r int) string       { return fmt.Sprintf("reduce_%d_output.sqlite3", r) }
+func reducePartialFile(r int) string      { return fmt.Sprintf("reduce_%d_partial.sqlite3", r) }
+func reduceTempFile(r int) string         { return fmt.Sprintf("reduce_%d_temp.sqlite3", r) }
+func makeURL(host, file string) string    { return fmt.Sprintf("http://%s/data/%s", host, file) }
+func jobDir(job int) string               { return fmt.Sprintf("data/%d/", job) }
+func jobFile(job int, file string) string { return fmt.Sprintf("%d/%s", job, file) }
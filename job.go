@@ -0,0 +1,525 @@
+package mapreduce
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JobSpec struct {
+	Name        string
+	Source      string            // path of the input database on the master
+	M, R        int               // number of map and reduce tasks
+	Config      map[string]string // passed on to the job's tasks
+	Partitioner PartitionerSpec   // how map output is split between reduce tasks
+	Sorted      bool              // sort the output across reduce tasks, replacing Partitioner
+	Sort        SortSpec          // comparators for the reduce tasks' input
+}
+
+// job is the master's bookkeeping for one submitted job.
+type job struct {
+	id           int
+	spec         JobSpec
+	dir          string // where the job's files live on the master
+	mapTasks     []*MapTask
+	reduceTasks  []*ReduceTask
+	mapStates    []*taskState
+	reduceStates []*taskState
+	phase        int
+	err          error // why the job failed, if it did
+	cancelled    bool
+	merging      bool                       // the final merge is running
+	stopMerge    context.CancelFunc         // cancels the final merge while it runs
+	splitHolders []map[string]bool          // workers holding a copy of each map input
+	unreachable  map[string]map[string]bool // reducers unable to fetch map outputs from each host
+	counters     map[string]int64           // totals of the counters of finished tasks
+	journal      *sql.DB
+	done         chan struct{} // closed when the job is over
+	mux          *sync.Mutex   // the master's lock, which guards the job
+}
+
+func newJob(id int, spec JobSpec, address string, mux *sync.Mutex) *job {
+	j := new(job)
+	j.mux = mux
+	j.id = id
+	j.spec = spec
+	j.dir = jobDir(id)
+	j.counters = make(map[string]int64)
+	j.done = make(chan struct{})
+
+	for i := 0; i < spec.M; i++ {
+		mapTask := new(MapTask)
+		mapTask.Job = id
+		mapTask.M = spec.M
+		mapTask.R = spec.R
+		mapTask.N = i
+		mapTask.SourceHost = address
+		mapTask.Config = spec.Config
+		mapTask.Partitioner = spec.Partitioner
+		j.mapTasks = append(j.mapTasks, mapTask)
+		j.mapStates = append(j.mapStates, new(taskState))
+		j.splitHolders = append(j.splitHolders, make(map[string]bool))
+	}
+
+	for i := 0; i < spec.R; i++ {
+		reduceTask := new(ReduceTask)
+		reduceTask.Job = id
+		reduceTask.M = spec.M
+		reduceTask.R = spec.R
+		reduceTask.N = i
+		reduceTask.Config = spec.Config
+		reduceTask.Sort = spec.Sort
+		j.reduceTasks = append(j.reduceTasks, reduceTask)
+		j.reduceStates = append(j.reduceStates, new(taskState))
+	}
+	return j
+}
+
+func (j *job) String() string {
+	if j.spec.Name == "" {
+		return fmt.Sprintf("job %d", j.id)
+	}
+	return fmt.Sprintf("job %d (%s)", j.id, j.spec.Name)
+}
+
+// fillTask fills in the reply to GetTask for task n of the current phase.
+// A map task is pointed at the worker's own copy of its input if it has one.
+func (j *job) fillTask(Task *Task, n int, attempt int, address string) {
+	Task.JobID = j.id
+	Task.TaskID = n
+	Task.Attempt = attempt
+	if j.phase == 0 {
+		mapTask := *j.mapTasks[n]
+		if j.splitHolders[n][address] {
+			mapTask.SourceHost = address
+		}
+		mapTask.Skip = j.mapStates[n].skip
+		Task.MapTask = &mapTask
+	} else {
+		reduceTask := *j.reduceTasks[n]
+		reduceTask.Skip = j.reduceStates[n].skip
+		Task.ReduceTask = &reduceTask
+	}
+}
+
+// states returns the bookkeeping for the tasks of the current phase.
+func (j *job) states() []*taskState {
+	return j.phaseStates(j.phase)
+}
+
+// phaseStates returns the bookkeeping for the tasks of the given phase, or
+// nil if the phase has no tasks.
+func (j *job) phaseStates(phase int) []*taskState {
+	switch phase {
+	case 0:
+		return j.mapStates
+	case 1:
+		return j.reduceStates
+	}
+	return nil
+}
+
+// lookup returns the bookkeeping for a task named in an RPC, or nil if there
+// is no such task.
+func (j *job) lookup(phase int, id int) *taskState {
+	states := j.phaseStates(phase)
+	if id < 0 || id >= len(states) {
+		return nil
+	}
+	return states[id]
+}
+
+// completed counts the finished tasks of the current phase.
+func (j *job) completed() int {
+	return countCompleted(j.states())
+}
+
+func countCompleted(states []*taskState) int {
+	n := 0
+	for _, state := range states {
+		if state.status == taskCompleted {
+			n++
+		}
+	}
+	return n
+}
+
+// nextTask picks a task of the current phase to hand out to the given
+// worker: one that has never been assigned, or one whose worker has not
+// reported running it for longer than the timeout. A worker is never handed
+// a task it may still be running. Map tasks whose input split the worker
+// already holds come first, and one is left for a free worker holding its
+// split if this worker doesn't; held reports whether any task was left for
+// another worker. It returns -1 if there is no such task.
+func (j *job) nextTask(timeout time.Duration, address string, free []string) (n int, held bool) {
+	best, bestScore := -1, -1
+	for i, state := range j.states() {
+		switch state.status {
+		case taskIdle:
+		case taskInProgress:
+			if time.Since(state.renewed) <= timeout || state.worker == address || state.backup == address {
+				continue
+			}
+		default:
+			continue
+		}
+		score := j.locality(i, address)
+		if score <= bestScore {
+			continue
+		}
+		if j.betterPlaced(i, score, free) {
+			held = true
+			continue
+		}
+		best, bestScore = i, score
+	}
+	return best, held
+}
+
+// locality scores how much of the input of task n of the current phase the
+// given worker holds: for a map task, whether it has a copy of the input
+// split. Every reduce task reads a partition of every map output, so none
+// is closer to one worker than to another, and they all score 0.
+func (j *job) locality(n int, address string) int {
+	if j.phase == 0 && j.splitHolders[n][address] {
+		return 1
+	}
+	return 0
+}
+
+// betterPlaced reports whether one of the given workers scores higher than
+// score for task n.
+func (j *job) betterPlaced(n int, score int, workers []string) bool {
+	for _, address := range workers {
+		if j.locality(n, address) > score {
+			return true
+		}
+	}
+	return false
+}
+
+// straggler picks a running task to back up on the given worker: the one
+// that has been running longest, provided it has taken well over the median
+// time of the tasks already finished in this phase. Backups are only started
+// once at least half of the phase is done. It returns -1 if there is none.
+func (j *job) straggler(address string) int {
+	states := j.states()
+	var durations []time.Duration
+	for _, state := range states {
+		if state.status == taskCompleted {
+			durations = append(durations, state.duration)
+		}
+	}
+	if len(durations) == 0 || 2*len(durations) < len(states) {
+		return -1
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	median := durations[len(durations)/2]
+
+	n := -1
+	var longest time.Duration
+	for i, state := range states {
+		if state.status != taskInProgress || state.backup != "" || state.worker == address {
+			continue
+		}
+		elapsed := time.Since(state.started)
+		if elapsed > speculationFactor*median && elapsed > longest {
+			n = i
+			longest = elapsed
+		}
+	}
+	return n
+}
+
+// finish marks a task as completed by the given attempt, and reports whether
+// the attempt is a running copy of the task and the first one to finish.
+// Duplicate and stale completions are rejected.
+func (j *job) finish(state *taskState, address string, attempt int) bool {
+	if state.status != taskInProgress {
+		return false
+	}
+	switch {
+	case address == state.worker && attempt == state.attempt:
+		state.duration = time.Since(state.started)
+	case address == state.backup && attempt == state.backupAttempt:
+		state.duration = time.Since(state.backupStarted)
+		log.Printf("%v: backup copy on %s finished first, discarding the copy on %s", j, address, state.worker)
+	default:
+		return false
+	}
+	state.status = taskCompleted
+	state.worker = address
+	state.backup = ""
+	return true
+}
+
+// advance moves the job on to the next phase once every task of the current
+// phase is done. The reduce phase only ends when every map task is done too,
+// since map outputs may have been lost and scheduled to run again. The
+// final merge then runs in the background, since it must not hold up the
+// master; it is cancelled if a reduce output it needs is forgotten or the job
+// ends. The caller must hold the master's lock.
+func (j *job) advance() {
+	if j.phase == 0 && countCompleted(j.mapStates) == len(j.mapTasks) {
+		j.shuffle()
+		if err := j.checkShuffle(); err != nil {
+			j.fail(err)
+			return
+		}
+		j.phase = 1
+	}
+	if j.phase == 1 && !j.merging && countCompleted(j.mapStates) == len(j.mapTasks) && countCompleted(j.reduceStates) == len(j.reduceTasks) {
+		// merged in partition order, so that a range partitioned job's
+		// output comes out sorted
+		var urls []string
+		for n, state := range j.reduceStates {
+			urls = append(urls, state.location+reduceOutputFile(n))
+		}
+		var ctx context.Context
+		ctx, j.stopMerge = context.WithCancel(context.Background())
+		j.merging = true
+		go j.merge(ctx, urls)
+	}
+}
+
+// merge gathers the reduce outputs into the job's final output, without
+// holding the master's lock while it downloads them, and then ends the job.
+// Reduce tasks whose outputs can't be fetched are run again, after which
+// advance starts another merge.
+func (j *job) merge(ctx context.Context, urls []string) {
+	log.Printf("%v: merging %d reduce outputs", j, len(urls))
+	inputDB, err := mergeDatabases(ctx, urls, j.dir+"final.sqlite3", j.dir+"temp.sqlite3", "", new(taskCounters))
+	if inputDB != nil {
+		inputDB.Close()
+	}
+
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	stopped := ctx.Err() != nil
+	j.merging = false
+	j.stopMerge()
+	j.stopMerge = nil
+	if j.phase > 1 {
+		// cancelled while merging
+		return
+	}
+	if err != nil && stopped {
+		// a reduce output was forgotten, and its task will run again
+		log.Printf("%v: final merge stopped", j)
+		j.advance()
+		return
+	}
+	if fetchErr, ok := err.(*fetchError); ok {
+		// run the reduce tasks whose outputs were lost again; their outputs
+		// may also have been replaced while the merge ran, in which case
+		// advance merges again straight away
+		log.Printf("%v: final merge: %v", j, fetchErr)
+		for _, url := range fetchErr.urls {
+			for n, state := range j.reduceStates {
+				if state.status == taskCompleted && state.location+reduceOutputFile(n) == url {
+					j.forgetReduceOutput(n)
+				}
+			}
+		}
+		j.advance()
+		return
+	}
+	if err != nil {
+		j.fail(fmt.Errorf("final merge: %v", err))
+		return
+	}
+	log.Printf("%v finished, output in %s", j, j.dir+"final.sqlite3")
+	log.Printf("%v counters: %s", j, formatCounters(j.counters))
+	j.end()
+}
+
+// reportSkipped logs the keys each task of the job left out.
+func (j *job) reportSkipped() {
+	for n, state := range j.mapStates {
+		if len(state.skip) > 0 {
+			log.Printf("%v: map task %d skipped keys %q", j, n, state.skip)
+		}
+	}
+	for n, state := range j.reduceStates {
+		if len(state.skip) > 0 {
+			log.Printf("%v: reduce task %d skipped keys %q", j, n, state.skip)
+		}
+	}
+}
+
+// fail ends the job with an error.
+func (j *job) fail(err error) {
+	if j.phase > 1 {
+		return
+	}
+	j.err = err
+	log.Printf("%v failed: %v", j, err)
+	j.end()
+}
+
+// end marks the job as over and lets anyone waiting for it know.
+func (j *job) end() {
+	if j.phase == 2 {
+		return
+	}
+	j.phase = 2
+	if j.stopMerge != nil {
+		j.stopMerge()
+	}
+	j.reportSkipped()
+	j.recordFinished()
+	close(j.done)
+}
+
+// cancel ends the job at an operator's request, and removes its files from
+// the master apart from the journal, which keeps the job from being resumed.
+func (j *job) cancel() {
+	j.fail(errors.New("cancelled"))
+	j.cancelled = true
+
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		log.Printf("%v: cleaning up: %v", j, err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() != journalFile {
+			os.RemoveAll(filepath.Join(j.dir, entry.Name()))
+		}
+	}
+}
+
+// shuffle points each reduce task at its partition of every map task's
+// output: reduce task i reads map_N_output_i from wherever map task N ran.
+func (j *job) shuffle() {
+	for i, task := range j.reduceTasks {
+		task.SourceHosts = nil
+		for n, state := range j.mapStates {
+			if state.status == taskCompleted {
+				task.SourceHosts = append(task.SourceHosts, state.location+mapOutputFile(n, i))
+			}
+		}
+	}
+}
+
+// checkShuffle makes sure every reduce task has one source per map task
+// before the reduce phase starts.
+func (j *job) checkShuffle() error {
+	for i, task := range j.reduceTasks {
+		if len(task.SourceHosts) != len(j.mapTasks) {
+			return fmt.Errorf("reduce task %d has %d map outputs, expected %d", i, len(task.SourceHosts), len(j.mapTasks))
+		}
+		for n, url := range task.SourceHosts {
+			if !strings.HasSuffix(url, "/"+mapOutputFile(n, i)) {
+				return fmt.Errorf("reduce task %d source %d is %s, expected %s", i, n, url, mapOutputFile(n, i))
+			}
+		}
+	}
+	return nil
+}
+
+// forget discards every completed task whose output lives on the given
+// host, which has gone, so that it will be run again elsewhere.
+func (j *job) forget(host string) {
+	if j.phase > 1 {
+		return
+	}
+	j.forgetSplits(host)
+	j.forgetMapOutputs(host)
+	for i, state := range j.reduceStates {
+		if state.status == taskCompleted && state.worker == host {
+			j.forgetReduceOutput(i)
+		}
+	}
+}
+
+// forgetMapOutputs reruns the completed map tasks whose output lives on the
+// given host. If map outputs are lost during the reduce phase the job goes
+// back to the map phase until they have been regenerated, and the reduce
+// tasks' sources are rebuilt when it moves on again.
+func (j *job) forgetMapOutputs(host string) {
+	if j.phase > 1 {
+		return
+	}
+	delete(j.unreachable, host)
+
+	lost := 0
+	for i, state := range j.mapStates {
+		if state.status == taskCompleted && state.worker == host {
+			log.Printf("%v: map task %d output on %s lost, rerunning", j, i, host)
+			state.status = taskIdle
+			j.record(0, i)
+			lost++
+		}
+	}
+	if lost > 0 && j.phase == 1 {
+		j.phase = 0
+	}
+}
+
+// forgetReduceOutput reruns completed reduce task n, and stops a final merge
+// that is reading its output.
+func (j *job) forgetReduceOutput(n int) {
+	state := j.reduceStates[n]
+	log.Printf("%v: reduce task %d output on %s lost, rerunning", j, n, state.worker)
+	state.status = taskIdle
+	j.record(1, n)
+	if j.stopMerge != nil {
+		j.stopMerge()
+	}
+}
+
+// fetchFailed records that reducer could not download map outputs from
+// host, and reports whether enough reducers have failed to reach it for its
+// map outputs to be given up on. live is how many usable workers other than
+// host could have reported it.
+func (j *job) fetchFailed(host, reducer string, live int) bool {
+	if j.unreachable == nil {
+		j.unreachable = make(map[string]map[string]bool)
+	}
+	if j.unreachable[host] == nil {
+		j.unreachable[host] = make(map[string]bool)
+	}
+	j.unreachable[host][reducer] = true
+	needed := fetchFailureReports
+	if live < needed {
+		needed = live
+	}
+	return len(j.unreachable[host]) >= needed
+}
+
+// forgetSplits stops counting on the given worker's copies of the map inputs.
+func (j *job) forgetSplits(host string) {
+	for _, holders := range j.splitHolders {
+		delete(holders, host)
+	}
+}
+
+// addCounters adds the counters of a finished task to the job's totals.
+func (j *job) addCounters(counters map[string]int64) {
+	for name, n := range counters {
+		j.counters[name] += n
+	}
+}
+
+// formatCounters lists counters by name.
+func formatCounters(counters map[string]int64) string {
+	var names []string
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, counters[name]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,224 @@
+package mapreduce
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// journalFile records the master's progress through a job, so that a
+// restarted master can pick up where it left off instead of starting over.
+// Each job has its own, in its directory under data/.
+const journalFile = "journal.sqlite3"
+
+// createJournal starts a new journal for a job.
+func createJournal(path string, spec JobSpec) (*sql.DB, error) {
+	os.Remove(path)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlStmt := `
+	create table job (name text, m integer, r integer, source text, partitioner text, sorted integer, sort text, finished integer);
+	create table config (key text primary key, value text);
+	create table tasks (
+		phase integer, task integer, status integer, attempts integer, failures integer,
+		worker text, location text, skip text,
+		primary key (phase, task));
+	`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		log.Printf("%q: %s\n", err, sqlStmt)
+		db.Close()
+		return nil, err
+	}
+
+	partitioner, err := json.Marshal(spec.Partitioner)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	sortSpec, err := json.Marshal(spec.Sort)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	_, err = db.Exec("insert into job(name, m, r, source, partitioner, sorted, sort, finished) values(?, ?, ?, ?, ?, ?, ?, 0)",
+		spec.Name, spec.M, spec.R, spec.Source, string(partitioner), spec.Sorted, string(sortSpec))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for key, value := range spec.Config {
+		if _, err = db.Exec("insert into config(key, value) values(?, ?)", key, value); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// openJournal opens an existing journal and reads back the job it describes.
+func openJournal(path string) (db *sql.DB, spec JobSpec, finished bool, err error) {
+	db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, spec, false, err
+	}
+	var partitioner, sortSpec string
+	err = db.QueryRow("select name, m, r, source, partitioner, sorted, sort, finished from job").Scan(&spec.Name, &spec.M, &spec.R, &spec.Source, &partitioner, &spec.Sorted, &sortSpec, &finished)
+	if err != nil {
+		db.Close()
+		return nil, spec, false, err
+	}
+	if err = json.Unmarshal([]byte(partitioner), &spec.Partitioner); err != nil {
+		db.Close()
+		return nil, spec, false, err
+	}
+	if err = json.Unmarshal([]byte(sortSpec), &spec.Sort); err != nil {
+		db.Close()
+		return nil, spec, false, err
+	}
+	spec.Config, err = readConfig(db)
+	if err != nil {
+		db.Close()
+		return nil, spec, false, err
+	}
+	return db, spec, finished, nil
+}
+
+// readConfig reads back a job's configuration from its journal.
+func readConfig(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query("select key, value from config")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	config := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		config[key] = value
+	}
+	return config, rows.Err()
+}
+
+// record saves the state of a task to the journal.
+func (j *job) record(phase int, n int) {
+	if j.journal == nil {
+		return
+	}
+	state := j.phaseStates(phase)[n]
+	skip, err := json.Marshal(state.skip)
+	if err != nil {
+		log.Printf("%v: journal: recording phase %d task %d: %v", j, phase, n, err)
+		return
+	}
+	_, err = j.journal.Exec("insert or replace into tasks(phase, task, status, attempts, failures, worker, location, skip) values(?, ?, ?, ?, ?, ?, ?, ?)",
+		phase, n, state.status, state.attempts, state.failures, state.worker, state.location, string(skip))
+	if err != nil {
+		log.Printf("%v: journal: recording phase %d task %d: %v", j, phase, n, err)
+	}
+}
+
+// recordFinished marks the job as over in the journal, so that it is not
+// resumed by the next master to start in this directory.
+func (j *job) recordFinished() {
+	if j.journal == nil {
+		return
+	}
+	if _, err := j.journal.Exec("update job set finished = 1"); err != nil {
+		log.Printf("%v: journal: recording job end: %v", j, err)
+	}
+}
+
+// restore loads task states from the journal. Tasks that were running when
+// the old master stopped are handed out again, still skipping the keys they
+// had failed on; finished map outputs are used where they are, and rerun if
+// their worker turns out to be gone.
+func (j *job) restore() error {
+	rows, err := j.journal.Query("select phase, task, status, attempts, failures, worker, location, skip from tasks")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var phase, n int
+		var skip string
+		state := new(taskState)
+		err = rows.Scan(&phase, &n, &state.status, &state.attempts, &state.failures, &state.worker, &state.location, &skip)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal([]byte(skip), &state.skip); err != nil {
+			return err
+		}
+		states := j.phaseStates(phase)
+		if n < 0 || n >= len(states) {
+			continue
+		}
+		if state.status == taskInProgress {
+			state.status = taskIdle
+		}
+		states[n] = state
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("%v: resumed with %d of %d map tasks and %d of %d reduce tasks done",
+		j, countCompleted(j.mapStates), len(j.mapTasks), countCompleted(j.reduceStates), len(j.reduceTasks))
+	j.advance()
+	return nil
+}
+
+// resume picks up every unfinished job journaled under data/ by an earlier
+// master, and makes sure new jobs get fresh IDs.
+func (w *Work) resume() {
+	entries, err := os.ReadDir("data")
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		if id >= w.nextJobID {
+			w.nextJobID = id + 1
+		}
+
+		path := filepath.Join(jobDir(id), journalFile)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		db, spec, finished, err := openJournal(path)
+		if err != nil {
+			log.Printf("job %d: opening journal: %v", id, err)
+			continue
+		}
+		if finished {
+			db.Close()
+			continue
+		}
+		j := newJob(id, spec, w.address, &w.Mux)
+		j.journal = db
+		if err = j.restore(); err != nil {
+			log.Printf("%v: restoring from journal: %v", j, err)
+			db.Close()
+			continue
+		}
+		w.jobs = append(w.jobs, j)
+	}
+	sort.Slice(w.jobs, func(a, b int) bool { return w.jobs[a].id < w.jobs[b].id })
+}
@@ -8,55 +8,182 @@ import (
 	"net/rpc"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 var m int
 var r int
 
+const (
+	taskIdle = iota
+	taskInProgress
+	taskCompleted
+)
+
+// taskState is the master's bookkeeping for a single map or reduce task.
+type taskState struct {
+	status        int
+	worker        string        // address of the worker holding the task
+	started       time.Time     // when the task was last handed out
+	renewed       time.Time     // when worker last reported running it
+	attempt       int           // attempt number of the copy on worker
+	attempts      int           // copies handed out so far
+	failures      int           // attempts that have reported an error
+	backup        string        // address of the worker running a speculative copy, if any
+	backupStarted time.Time     // when the speculative copy was handed out
+	backupRenewed time.Time     // when backup last reported running it
+	backupAttempt int           // attempt number of the speculative copy
+	duration      time.Duration // how long the winning copy took
+	location      string        // url of the directory holding the task's output
+	skip          []string      // keys the task has failed on, left out of later attempts
+}
+
+// A running task becomes a candidate for a backup copy once it has taken
+// this many times longer than the median finished task of its phase.
+const speculationFactor = 2
+
+// A live worker's map outputs are only given up on once this many different
+// reducers have failed to fetch them, or every other usable worker has.
+const fetchFailureReports = 3
+
 type Work struct {
-	mapTasks         []*MapTask
-	reduceTasks      []*ReduceTask
-	phase            int
-	nextTask         int
-	tasksCompleted   int
-	reduceOutputUrls []string
-	Mux              sync.Mutex
+	address       string
+	jobs          []*job // in submission order
+	nextJobID     int
+	taskTimeout   time.Duration
+	maxAttempts   int
+	maxSkip       int // keys a task may skip before its failures count, 0 to never skip
+	speculate     bool
+	maxFailures   int           // blacklist a worker after this many failures, 0 for never
+	failureWindow time.Duration // within this long
+	workers       map[string]*workerInfo
+	stopping      bool
+	stopped       chan struct{} // closed when the master starts shutting down
+	changed       chan struct{} // closed and replaced whenever a task may have become available
+	Mux           sync.Mutex
 }
 
 type Task struct {
 	MapTask    *MapTask
 	ReduceTask *ReduceTask
+	JobID      int
 	TaskID     int
+	Attempt    int
 	Finished   bool
+	Cancelled  []int // jobs that have been cancelled
+}
+
+type TaskRequest struct {
+	Address string
+	Slots   int // how many tasks the worker can run at once
+}
+
+type TaskFailure struct {
+	JobID   int
+	TaskID  int
+	Phase   int
+	Attempt int
+	Address string
+	Error   string
+	Key     string // the key Map or Reduce failed on, if BadKey is set
+	BadKey  bool
+}
+
+type FetchFailure struct {
+	JobID   int
+	TaskID  int
+	Address string
+	URLs    []string // map outputs the reduce task could not download
 }
 
 type TaskFinInfo struct {
+	JobID      int
 	TaskID     int
+	Phase      int
+	Attempt    int
 	SourceHost string
 	Address    string
 	Directory  string
+	Counters   map[string]int64 // tallies kept while the task ran, by name
 }
 
 type handler func(*Work)
 type Nothing struct{}
 type Server chan<- handler
 
+// Start runs a master, a worker or one of the commands that talk to a
+// running master, as chosen by the command line. Workers run client's Map
+// and Reduce.
 func Start(client Interface) error {
+	return StartContext(contextAdapter{client})
+}
+
+// StartContext is like Start, for clients that watch for their tasks being
+// revoked.
+func StartContext(client ContextInterface) error {
 	var address string
 	var masteraddress string
+	var target string // worker to take off the blacklist, or job to cancel
 	var mstr string
 	var rstr string
 	var err error
 	var sourcefile string
 	var isMaster bool
+	var isSubmit bool
+	var isShutdown bool
+	var isStatus bool
+	var isClear bool
+	var isCancel bool
+	var slots int
+	var name string
+	var partitioner string
+	var sorted bool
+	var sortSpec SortSpec
+	conf := make(confFlag)
+	var timeout time.Duration
+	var attempts int
+	var maxSkip int
+	var speculate bool
+	var maxFailures int
+	var failureWindow time.Duration
 	flag.BoolVar(&isMaster, "master", false, "start as a master")
+	flag.BoolVar(&isSubmit, "submit", false, "submit a job to a running master")
+	flag.BoolVar(&isShutdown, "shutdown", false, "stop a running master and its workers")
+	flag.BoolVar(&isStatus, "status", false, "show the jobs and workers of a running master")
+	flag.BoolVar(&isCancel, "cancel", false, "cancel a job on a running master")
+	flag.BoolVar(&isClear, "clearblacklist", false, "let a running master assign tasks to blacklisted workers again")
+	flag.IntVar(&slots, "slots", 1, "number of tasks a worker runs at once; the client must be safe for concurrent use if this is more than 1")
+	flag.StringVar(&name, "name", "", "name of the submitted job")
+	flag.StringVar(&partitioner, "partitioner", "hash", "how the submitted job splits map output between reduce tasks: hash, range:split,split,... or prefix:length")
+	flag.BoolVar(&sorted, "sorted", false, "sort the submitted job's output across all reduce tasks, splitting keys by a sample of the input keys")
+	flag.StringVar(&sortSpec.Keys, "sortkeys", "", "comparator the submitted job's reduce tasks sort keys by: bytes, reverse, nocase, numeric or a registered name")
+	flag.StringVar(&sortSpec.Values, "sortvalues", "", "comparator the submitted job's reduce tasks sort each key's values by")
+	flag.StringVar(&sortSpec.Group, "groupkeys", "", "comparator deciding which sorted keys share a Reduce call; defaults to -sortkeys")
+	flag.Var(conf, "conf", "set key=value in the configuration of the submitted job; may be repeated")
+	flag.IntVar(&attempts, "attempts", 4, "fail the job once a task has failed this many times")
+	flag.IntVar(&maxSkip, "maxskip", 0, "retry a task without the keys Map or Reduce fails on, up to this many per task")
+	flag.BoolVar(&speculate, "speculate", true, "run backup copies of straggling tasks near the end of a phase")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "reassign a task if its worker stops reporting it for this long")
+	flag.IntVar(&maxFailures, "blacklist", 3, "stop assigning tasks to a worker once it has failed this many within the blacklist window; 0 disables blacklisting")
+	flag.DurationVar(&failureWindow, "blacklistwindow", 10*time.Minute, "how far back failures count towards blacklisting a worker")
 	flag.Parse()
 
 	switch flag.NArg() {
 
+	case 1:
+		if isMaster || isShutdown || isStatus || isClear {
+			address = flag.Arg(0)
+		} else {
+			printUsage()
+		}
+
 	case 2:
-		if !isMaster {
+		if isClear || isCancel {
+			address = flag.Arg(0)
+			target = flag.Arg(1)
+		} else if !isMaster && !isSubmit && !isShutdown && !isStatus {
 			address = flag.Arg(0)
 			masteraddress = flag.Arg(1)
 		} else {
@@ -64,7 +191,7 @@ func Start(client Interface) error {
 		}
 
 	case 4:
-		if isMaster {
+		if isMaster || isSubmit {
 			address = flag.Arg(0)
 			mstr = flag.Arg(1)
 			rstr = flag.Arg(2)
@@ -74,7 +201,7 @@ func Start(client Interface) error {
 			}
 			r, err = strconv.Atoi(rstr)
 			if err != nil {
-				log.Fatal("m is not an integer")
+				log.Fatal("r is not an integer")
 			}
 			sourcefile = flag.Arg(3)
 		} else {
@@ -85,130 +212,596 @@ func Start(client Interface) error {
 		printUsage()
 	}
 
-	if isMaster {
-		master(address, m, r, sourcefile)
-	} else {
-		worker(address, masteraddress, client)
+	var spec *JobSpec
+	if sourcefile != "" {
+		spec = &JobSpec{Name: name, Source: sourcefile, M: m, R: r, Config: conf, Partitioner: parsePartitionerSpec(partitioner), Sorted: sorted, Sort: sortSpec}
+	}
+
+	switch {
+	case isMaster:
+		err = master(address, spec, timeout, attempts, maxSkip, speculate, maxFailures, failureWindow)
+	case isSubmit:
+		var id int
+		id, err = submit(address, *spec)
+		if err == nil {
+			fmt.Printf("submitted job %d\n", id)
+		}
+	case isShutdown:
+		err = shutdown(address)
+	case isStatus:
+		var status StatusReply
+		status, err = getStatus(address)
+		if err == nil {
+			printStatus(status)
+		}
+	case isClear:
+		var cleared int
+		cleared, err = clearBlacklist(address, target)
+		if err == nil {
+			fmt.Printf("cleared %d blacklisted workers\n", cleared)
+		}
+	case isCancel:
+		var id int
+		id, err = strconv.Atoi(target)
+		if err != nil {
+			log.Fatal("job id is not an integer")
+		}
+		err = cancelJob(address, id)
+		if err == nil {
+			fmt.Printf("cancelled job %d\n", id)
+		}
+	default:
+		if slots < 1 {
+			log.Fatal("a worker needs at least one slot")
+		}
+		worker(address, masteraddress, client, slots)
 	}
 	return err
 }
 
+// confFlag collects -conf key=value flags into a job configuration.
+type confFlag map[string]string
+
+func (c confFlag) String() string {
+	var parts []string
+	for k, v := range c {
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (c confFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return fmt.Errorf("%q is not key=value", s)
+	}
+	c[s[:i]] = s[i+1:]
+	return nil
+}
+
 func printUsage() {
 	fmt.Printf("\nUsage: %s :\n", os.Args[0])
-	fmt.Println("master: [-master address (int mapTasks) (in reduceTasks) filename ]")
-	fmt.Println("worker: [address masteraddress]")
+	fmt.Println("master: [-master address [(int mapTasks) (int reduceTasks) filename] ]")
+	fmt.Println("submit: [-submit [-name jobname] [-conf key=value ...] [-partitioner spec | -sorted] [-sortkeys cmp] [-sortvalues cmp] [-groupkeys cmp] masteraddress (int mapTasks) (int reduceTasks) filename ]")
+	fmt.Println("shutdown: [-shutdown masteraddress]")
+	fmt.Println("status: [-status masteraddress]")
+	fmt.Println("clear blacklist: [-clearblacklist masteraddress [workeraddress]]")
+	fmt.Println("cancel: [-cancel masteraddress jobid]")
+	fmt.Println("worker: [[-slots n] address masteraddress]")
 	flag.PrintDefaults()
 	os.Exit(0)
 }
 
-func master(address string, m int, r int, sourcefile string) {
+// master runs a master until it is shut down. If it was started with a job,
+// it shuts down by itself once that job is over and returns the job's error.
+func master(address string, spec *JobSpec, timeout time.Duration, attempts int, maxSkip int, speculate bool, maxFailures int, failureWindow time.Duration) error {
 	fmt.Println("Setting Up")
 
-	_, err := splitDatabase(sourcefile, "data/map_%d_source.sqlite3", m)
-	if err != nil {
-		log.Fatal(err)
+	w := new(Work)
+	w.address = address
+	w.taskTimeout = timeout
+	w.maxAttempts = attempts
+	w.maxSkip = maxSkip
+	w.speculate = speculate
+	w.maxFailures = maxFailures
+	w.failureWindow = failureWindow
+	w.workers = make(map[string]*workerInfo)
+	w.stopped = make(chan struct{})
+	w.changed = make(chan struct{})
+	w.resume()
+
+	var first *job
+	if spec != nil {
+		// a master restarted with the same job picks it up from the journal
+		// rather than starting it again
+		first = w.resumedJob(*spec)
+		if first != nil {
+			log.Printf("%v: continuing resumed job instead of submitting it again", first)
+		} else {
+			id, err := w.submit(*spec)
+			if err != nil {
+				return err
+			}
+			first = w.job(id)
+		}
 	}
+	fmt.Println("Ready")
+	go w.monitor()
+	srv := server(w, address)
 
-	w := new(Work)
+	if first != nil {
+		select {
+		case <-first.done:
+			w.Mux.Lock()
+			w.stop()
+			w.Mux.Unlock()
+		case <-w.stopped:
+		}
+	} else {
+		<-w.stopped
+	}
+	w.waitForWorkers()
+	closeServer(srv)
+	log.Println("master stopped")
 
-	for i := 0; i < m; i++ {
-		mapTask := new(MapTask)
-		mapTask.M = m
-		mapTask.R = r
-		mapTask.N = i
-		mapTask.SourceHost = address
-		w.mapTasks = append(w.mapTasks, mapTask)
+	if first != nil {
+		w.Mux.Lock()
+		defer w.Mux.Unlock()
+		if first.phase < 2 {
+			return fmt.Errorf("%v did not finish before the master was shut down", first)
+		}
+		return first.err
 	}
+	return nil
+}
 
-	for i := 0; i < r; i++ {
-		reduceTask := new(ReduceTask)
-		reduceTask.M = m
-		reduceTask.R = r
-		reduceTask.N = i
-		w.reduceTasks = append(w.reduceTasks, reduceTask)
+// resumedJob returns the job picked up from the journal that matches spec,
+// or nil if there is none. A resumed job of the same name and input whose
+// settings differ is left to run on its own, and logged.
+func (w *Work) resumedJob(spec JobSpec) *job {
+	w.Mux.Lock()
+	defer w.Mux.Unlock()
+	for _, j := range w.jobs {
+		if sameSpec(j.spec, spec) {
+			return j
+		}
 	}
-	fmt.Println("Ready")
-	server(w, address)
+	for _, j := range w.jobs {
+		if j.spec.Name == spec.Name && j.spec.Source == spec.Source {
+			log.Printf("%v was resumed with different settings, submitting the job again", j)
+		}
+	}
+	return nil
+}
 
+// sameSpec reports whether a job resumed from the journal is the one spec
+// asks for. A sorted job's partitioner was picked when it was submitted, so
+// it is not compared.
+func sameSpec(resumed, spec JobSpec) bool {
+	if resumed.Name != spec.Name || resumed.Source != spec.Source || resumed.M != spec.M || resumed.R != spec.R ||
+		resumed.Sorted != spec.Sorted || resumed.Sort != spec.Sort || len(resumed.Config) != len(spec.Config) {
+		return false
+	}
+	for key, value := range spec.Config {
+		if v, ok := resumed.Config[key]; !ok || v != value {
+			return false
+		}
+	}
+	return spec.Sorted || partitionerName(resumed.Partitioner) == partitionerName(spec.Partitioner)
+}
+
+// partitionerName is a partitioner spec as given to -partitioner, with the
+// default spelled out.
+func partitionerName(spec PartitionerSpec) string {
+	if spec.Name == "" {
+		spec.Name = "hash"
+	}
+	return spec.String()
 }
 
-func (w *Work) GetTask(junk *Nothing, Task *Task) error {
+// submit splits the input of a new job into its job directory and queues
+// it behind the jobs already running.
+func (w *Work) submit(spec JobSpec) (int, error) {
+	if spec.M < 1 || spec.R < 1 {
+		return 0, fmt.Errorf("a job needs at least one map and one reduce task")
+	}
+	if _, err := newPartitioner(spec.Partitioner); err != nil {
+		return 0, err
+	}
+	if spec.Partitioner.Name == "range" && len(spec.Partitioner.Args) != spec.R-1 {
+		return 0, fmt.Errorf("a range partitioner needs %d split points for %d reduce tasks", spec.R-1, spec.R)
+	}
+	if spec.Sorted && spec.Partitioner.Name != "" && spec.Partitioner.Name != "hash" {
+		return 0, fmt.Errorf("a sorted job picks its own partitioner")
+	}
+	if err := spec.Sort.check(); err != nil {
+		return 0, err
+	}
+	if spec.Sorted && spec.Sort.Keys != "" && spec.Sort.Keys != "bytes" {
+		return 0, fmt.Errorf("a sorted job's split points order keys bytewise")
+	}
+
+	w.Mux.Lock()
+	id := w.nextJobID
+	w.nextJobID++
+	w.Mux.Unlock()
+
+	dir := jobDir(id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	samples := 0
+	if spec.Sorted {
+		samples = sampleSize
+	}
+	_, sample, err := splitDatabase(spec.Source, dir+"map_%d_source.sqlite3", spec.M, samples)
+	if err != nil {
+		os.RemoveAll(dir)
+		return 0, fmt.Errorf("splitting %s: %v", spec.Source, err)
+	}
+	if spec.Sorted {
+		spec.Partitioner = PartitionerSpec{Name: "range", Args: splitPoints(sample, spec.R)}
+		log.Printf("job %d: sorting with split points %q", id, spec.Partitioner.Args)
+	}
+
+	j := newJob(id, spec, w.address, &w.Mux)
+	j.journal, err = createJournal(j.dir+journalFile, spec)
+	if err != nil {
+		log.Printf("%v: creating journal: %v", j, err)
+	}
+
+	w.Mux.Lock()
+	w.jobs = append(w.jobs, j)
+	w.notify()
+	w.Mux.Unlock()
+	log.Printf("%v queued: %s, %d map tasks, %d reduce tasks", j, spec.Source, spec.M, spec.R)
+	return id, nil
+}
+
+// SubmitJob queues a new job and replies with its ID.
+func (w *Work) SubmitJob(spec JobSpec, id *int) error {
+	n, err := w.submit(spec)
+	if err != nil {
+		return err
+	}
+	*id = n
+	return nil
+}
+
+// CancelJob stops a job that has not finished yet. Its tasks are revoked
+// from the workers running them, and its files are removed from the master
+// and the workers.
+func (w *Work) CancelJob(id int, reply *Nothing) error {
 	w.Mux.Lock()
 	defer w.Mux.Unlock()
+	defer w.notify()
+
+	j := w.job(id)
+	if j == nil {
+		return fmt.Errorf("no job %d", id)
+	}
+	if j.phase > 1 {
+		return fmt.Errorf("%v is already over", j)
+	}
+	j.cancel()
+	return nil
+}
+
+// cancelledJobs lists the IDs of the jobs that have been cancelled. The
+// caller must hold w.Mux.
+func (w *Work) cancelledJobs() []int {
+	var ids []int
+	for _, j := range w.jobs {
+		if j.cancelled {
+			ids = append(ids, j.id)
+		}
+	}
+	return ids
+}
 
-	fmt.Printf("work phase: %v  nextTask: %v  tasksCompleted: %v  len(maptasks): %v  len(reducetasks): %v\n", w.phase, w.nextTask, w.tasksCompleted, len(w.mapTasks), len(w.reduceTasks))
-	switch w.phase {
-	case 0:
-		if w.nextTask < len(w.mapTasks) {
-			Task.MapTask = w.mapTasks[w.nextTask]
-			Task.TaskID = w.nextTask
-			w.nextTask++
+// job returns the job with the given ID, or nil if there is none.
+// The caller must hold w.Mux.
+func (w *Work) job(id int) *job {
+	for _, j := range w.jobs {
+		if j.id == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// pollTimeout is how long GetTask waits for a task to become available
+// before replying that there is nothing to do.
+const pollTimeout = 10 * time.Second
+
+// GetTask hands the worker a task, waiting up to pollTimeout for one to
+// become available.
+// It also returns early if a job is cancelled, so that the worker hears
+// about it.
+func (w *Work) GetTask(req TaskRequest, Task *Task) error {
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+	seen := -1
+	for {
+		w.Mux.Lock()
+		Task.Cancelled = w.cancelledJobs()
+		if seen < 0 {
+			seen = len(Task.Cancelled)
+		}
+		if w.assign(req, Task) || len(Task.Cancelled) != seen {
+			w.Mux.Unlock()
 			return nil
-		} else {
+		}
+		changed := w.changed
+		info := w.workers[req.Address]
+		info.waiting++
+		w.Mux.Unlock()
 
+		timedOut := false
+		select {
+		case <-changed:
+		case <-timeout.C:
+			timedOut = true
 		}
-	case 1:
-		if w.nextTask < len(w.reduceTasks) {
-			Task.ReduceTask = w.reduceTasks[w.nextTask]
-			Task.TaskID = w.nextTask
-			w.nextTask += 1
+		w.Mux.Lock()
+		info.waiting--
+		w.Mux.Unlock()
+		if timedOut {
 			return nil
 		}
+	}
+}
 
-	case 2:
+// notify wakes up any GetTask calls waiting for work. The caller must hold
+// w.Mux.
+func (w *Work) notify() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// assign fills in a reply to GetTask if there is anything for the worker to
+// do, and reports whether there was. The caller must hold w.Mux.
+func (w *Work) assign(req TaskRequest, Task *Task) bool {
+	info := w.touch(req.Address)
+	if w.stopping {
 		Task.Finished = true
+		return true
 	}
-	return nil
+	if req.Slots > 0 {
+		info.slots = req.Slots
+	}
+	if info.blacklisted {
+		return false
+	}
+	if w.running(req.Address) >= info.slots {
+		return false
+	}
+	free := w.freeWorkers(req.Address)
+	for _, j := range w.jobs {
+		if j.phase > 1 {
+			continue
+		}
+		n, held := j.nextTask(w.taskTimeout, req.Address, free)
+		if held {
+			// make sure the worker it was left for hears about it
+			w.notify()
+		}
+		if n < 0 {
+			continue
+		}
+		state := j.states()[n]
+		if state.status == taskInProgress {
+			log.Printf("%v: task %d on %s not reported for %v, reassigning to %s", j, n, state.worker, time.Since(state.renewed), req.Address)
+			w.workerFailed(state.worker)
+		}
+		state.attempts++
+		state.status = taskInProgress
+		state.worker = req.Address
+		state.started = time.Now()
+		state.renewed = state.started
+		state.attempt = state.attempts
+		state.backup = ""
+		j.record(j.phase, n)
+		log.Printf("%v: task %d of phase %d (attempt %d) assigned to %s, %d of %d done",
+			j, n, j.phase, state.attempt, req.Address, j.completed(), len(j.states()))
+
+		j.fillTask(Task, n, state.attempt, req.Address)
+		return true
+	}
+
+	// nothing left to hand out, so put the worker to use backing up a straggler
+	if !w.speculate {
+		return false
+	}
+	for _, j := range w.jobs {
+		if j.phase > 1 {
+			continue
+		}
+		n := j.straggler(req.Address)
+		if n < 0 {
+			continue
+		}
+		state := j.states()[n]
+		log.Printf("%v: task %d on %s has run for %v, starting a backup copy on %s", j, n, state.worker, time.Since(state.started), req.Address)
+		state.attempts++
+		state.backup = req.Address
+		state.backupStarted = time.Now()
+		state.backupRenewed = state.backupStarted
+		state.backupAttempt = state.attempts
+		j.record(j.phase, n)
+		j.fillTask(Task, n, state.backupAttempt, req.Address)
+		return true
+	}
+	return false
 }
 
 func (w *Work) FinishedTask(TaskFinInfo TaskFinInfo, reply *Nothing) error {
 	w.Mux.Lock()
 	defer w.Mux.Unlock()
-	switch w.phase {
-	case 0:
-		if w.tasksCompleted < len(w.mapTasks)-1 {
-			for i := 0; i < r; i++ {
-				w.reduceTasks[TaskFinInfo.TaskID%r].SourceHosts = append(w.reduceTasks[TaskFinInfo.TaskID%r].SourceHosts, "http://"+TaskFinInfo.Address+TaskFinInfo.Directory+mapOutputFile(TaskFinInfo.TaskID, i))
-			}
-			w.tasksCompleted++
-			return nil
+	defer w.notify()
+	info := w.touch(TaskFinInfo.Address)
+
+	var state *taskState
+	j := w.job(TaskFinInfo.JobID)
+	if j != nil {
+		state = j.lookup(TaskFinInfo.Phase, TaskFinInfo.TaskID)
+	}
+	if state == nil || j.phase > 1 || !j.finish(state, TaskFinInfo.Address, TaskFinInfo.Attempt) {
+		log.Printf("ignoring duplicate or stale result for job %d phase %d task %d attempt %d from %s", TaskFinInfo.JobID, TaskFinInfo.Phase, TaskFinInfo.TaskID, TaskFinInfo.Attempt, TaskFinInfo.Address)
+		return nil
+	}
+	info.tasksCompleted++
+
+	state.location = "http://" + TaskFinInfo.Address + TaskFinInfo.Directory
+	j.record(TaskFinInfo.Phase, TaskFinInfo.TaskID)
+	j.addCounters(TaskFinInfo.Counters)
+	if TaskFinInfo.Phase == 0 {
+		// the worker keeps its copy of the input in case the task is rerun
+		j.splitHolders[TaskFinInfo.TaskID][TaskFinInfo.Address] = true
+	}
+	j.advance()
+	return nil
+}
+
+// FailedTask is called by a worker whose task returned an error. The task is
+// handed out again until it has failed maxAttempts times, at which point the
+// whole job fails. Failures on a bad record aren't counted against the worker,
+// and nor are reports from copies the master has already given up on.
+func (w *Work) FailedTask(failure TaskFailure, reply *Nothing) error {
+	w.Mux.Lock()
+	defer w.Mux.Unlock()
+	defer w.notify()
+	w.touch(failure.Address)
+
+	j := w.job(failure.JobID)
+	if j == nil {
+		return nil
+	}
+	state := j.lookup(failure.Phase, failure.TaskID)
+	if state == nil || state.status != taskInProgress {
+		return nil
+	}
+	if failure.Address == state.backup && failure.Attempt == state.backupAttempt {
+		// the original copy is still running
+		log.Printf("%v: backup copy of task %d failed on %s: %s", j, failure.TaskID, failure.Address, failure.Error)
+		if !failure.BadKey {
+			w.workerFailed(failure.Address)
+		}
+		state.backup = ""
+		j.record(failure.Phase, failure.TaskID)
+		return nil
+	}
+	if failure.Address != state.worker || failure.Attempt != state.attempt {
+		return nil
+	}
+	if failure.BadKey && len(state.skip) < w.maxSkip && !contains(state.skip, failure.Key) {
+		// rerun the task without the key rather than count the failure;
+		// a backup copy would fail on the key too, so drop it
+		state.skip = append(state.skip, failure.Key)
+		log.Printf("%v: task %d failed on %s on key %q, skipping the key from now on (%d of %d skips): %s",
+			j, failure.TaskID, failure.Address, failure.Key, len(state.skip), w.maxSkip, failure.Error)
+		state.status = taskIdle
+		state.backup = ""
+		j.record(failure.Phase, failure.TaskID)
+		return nil
+	}
+	if !failure.BadKey {
+		w.workerFailed(failure.Address)
+	}
+	state.failures++
+	log.Printf("%v: task %d failed on %s (attempt %d of %d): %s", j, failure.TaskID, failure.Address, state.failures, w.maxAttempts, failure.Error)
+	if state.failures < w.maxAttempts {
+		if state.backup != "" {
+			// let the backup copy carry on as the only copy
+			state.worker = state.backup
+			state.started = state.backupStarted
+			state.renewed = state.backupRenewed
+			state.attempt = state.backupAttempt
+			state.backup = ""
 		} else {
-			for i := 0; i < r; i++ {
-				w.reduceTasks[TaskFinInfo.TaskID%r].SourceHosts = append(w.reduceTasks[TaskFinInfo.TaskID%r].SourceHosts, "http://"+TaskFinInfo.Address+TaskFinInfo.Directory+mapOutputFile(TaskFinInfo.TaskID, i))
-			}
-			w.phase = 1
-			w.nextTask = 0
-			w.tasksCompleted = 0
+			state.status = taskIdle
 		}
+		j.record(failure.Phase, failure.TaskID)
+		return nil
+	}
+	j.record(failure.Phase, failure.TaskID)
 
-	case 1:
-		if w.tasksCompleted < len(w.reduceTasks)-1 {
-			w.reduceOutputUrls = append(w.reduceOutputUrls, "http://"+TaskFinInfo.Address+TaskFinInfo.Directory+reduceOutputFile(TaskFinInfo.TaskID))
-			w.tasksCompleted++
-			return nil
-		} else {
-			w.reduceOutputUrls = append(w.reduceOutputUrls, "http://"+TaskFinInfo.Address+TaskFinInfo.Directory+reduceOutputFile(TaskFinInfo.TaskID))
-			w.phase = 2
-			fmt.Println(w.reduceOutputUrls)
-			inputDB, err := mergeDatabases(w.reduceOutputUrls, "data/final.sqlite3", "data/temp.sqlite3")
-			if err != nil {
-				log.Fatalf("final merge %v", err)
-			}
-			inputDB.Close()
+	kind := "map"
+	if failure.Phase == 1 {
+		kind = "reduce"
+	}
+	j.fail(fmt.Errorf("%s task %d failed %d times, last error: %s", kind, failure.TaskID, state.failures, failure.Error))
+	return nil
+}
+
+// FetchFailed is called by a reduce worker that could not download some of
+// its map outputs. The reduce task goes back to the pool. The map tasks that
+// produced the outputs are run again if their worker is dead, or if enough
+// reducers have failed to reach it; a single report may just be a network
+// blip, and doesn't justify rerunning everything the worker produced.
+func (w *Work) FetchFailed(args FetchFailure, reply *Nothing) error {
+	w.Mux.Lock()
+	defer w.Mux.Unlock()
+	defer w.notify()
+	w.touch(args.Address)
+	j := w.job(args.JobID)
+	if j == nil || j.phase > 1 {
+		return nil
+	}
+
+	log.Printf("%v: reduce task %d on %s could not fetch %v", j, args.TaskID, args.Address, args.URLs)
+	state := j.lookup(1, args.TaskID)
+	if state != nil && state.status == taskInProgress {
+		if state.backup == args.Address {
+			state.backup = ""
+		} else if state.worker == args.Address {
+			state.status = taskIdle
+			state.backup = ""
+		}
+		j.record(1, args.TaskID)
+	}
+	seen := make(map[string]bool)
+	for _, url := range args.URLs {
+		host := urlHost(url)
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		if info, ok := w.workers[host]; !ok || !info.alive || j.fetchFailed(host, args.Address, w.usable(host)) {
+			j.forgetMapOutputs(host)
 		}
-	case 2:
-		os.Exit(0)
 	}
 	return nil
 }
 
-func server(w *Work, address string) {
+// urlHost returns the host:port part of an http url.
+func urlHost(url string) string {
+	url = strings.TrimPrefix(url, "http://")
+	if i := strings.Index(url, "/"); i >= 0 {
+		url = url[:i]
+	}
+	return url
+}
+
+func contains(list []string, s string) bool {
+	for _, elt := range list {
+		if elt == s {
+			return true
+		}
+	}
+	return false
+}
+
+func server(w *Work, address string) *http.Server {
 	rpc.Register(w)
 	rpc.HandleHTTP()
 
 	http.Handle("/data/", http.StripPrefix("/data", http.FileServer(http.Dir("data"))))
-	if err := http.ListenAndServe(address, nil); err != nil {
-		log.Printf("Error in HTTP server for %s: %v", address, err)
-	}
-
+	srv := &http.Server{Addr: address}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error in HTTP server for %s: %v", address, err)
+		}
+	}()
+	return srv
 }
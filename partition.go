@@ -0,0 +1,167 @@
+package mapreduce
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Partitioner decides which of a job's r reduce tasks gets each key its map
+// tasks emit. It must return a number from 0 to r-1, and the same number
+// for the same key on every worker.
+type Partitioner interface {
+	Partition(key string, r int) int
+}
+
+// PartitionerSpec names a partitioner and its arguments. It is what the
+// master ships to the workers with a job, since code can't be shipped.
+type PartitionerSpec struct {
+	Name string   // hash (the default if empty), range, prefix or a registered name
+	Args []string // passed to the partitioner's constructor
+}
+
+func (spec PartitionerSpec) String() string {
+	if len(spec.Args) == 0 {
+		return spec.Name
+	}
+	return spec.Name + ":" + strings.Join(spec.Args, ",")
+}
+
+// parsePartitionerSpec parses name or name:arg,arg,... as given to -partitioner.
+func parsePartitionerSpec(s string) PartitionerSpec {
+	var spec PartitionerSpec
+	i := strings.Index(s, ":")
+	if i < 0 {
+		spec.Name = s
+		return spec
+	}
+	spec.Name = s[:i]
+	spec.Args = strings.Split(s[i+1:], ",")
+	return spec
+}
+
+var partitioners = struct {
+	sync.Mutex
+	byName map[string]func(args []string) (Partitioner, error)
+}{byName: map[string]func(args []string) (Partitioner, error){
+	"hash":   newHashPartitioner,
+	"range":  newRangePartitioner,
+	"prefix": newPrefixPartitioner,
+}}
+
+// RegisterPartitioner makes a partitioner available to jobs by name. Only
+// its name and arguments travel with a job, so every map worker builds its
+// own, and the master builds one to check the arguments on submission.
+func RegisterPartitioner(name string, constructor func(args []string) (Partitioner, error)) {
+	partitioners.Lock()
+	defer partitioners.Unlock()
+	partitioners.byName[name] = constructor
+}
+
+// newPartitioner builds the partitioner a spec names. A panic in a
+// registered constructor is returned as an error.
+func newPartitioner(spec PartitionerSpec) (p Partitioner, err error) {
+	name := spec.Name
+	if name == "" {
+		name = "hash"
+	}
+	partitioners.Lock()
+	constructor, ok := partitioners.byName[name]
+	partitioners.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no partitioner named %q", name)
+	}
+	if perr := protect(func() error {
+		p, err = constructor(spec.Args)
+		return nil
+	}); perr != nil {
+		return nil, fmt.Errorf("partitioner %v: %v", spec, perr)
+	}
+	return p, err
+}
+
+// hashPartitioner spreads keys evenly by their hash.
+type hashPartitioner struct{}
+
+func newHashPartitioner(args []string) (Partitioner, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("hash partitioner takes no arguments")
+	}
+	return hashPartitioner{}, nil
+}
+
+func (hashPartitioner) Partition(key string, r int) int {
+	hash := fnv.New32()
+	hash.Write([]byte(key))
+	return int(hash.Sum32()) % r
+}
+
+// rangePartitioner sends each key to the range it falls in, given sorted
+// split points: keys below the first go to reduce task 0, keys from the
+// first up to the second go to task 1, and so on. A job with r reduce tasks
+// needs r-1 split points.
+type rangePartitioner struct {
+	splits []string
+}
+
+func newRangePartitioner(args []string) (Partitioner, error) {
+	if !sort.StringsAreSorted(args) {
+		return nil, fmt.Errorf("range partitioner split points are not sorted")
+	}
+	return rangePartitioner{splits: args}, nil
+}
+
+func (p rangePartitioner) Partition(key string, r int) int {
+	n := sort.Search(len(p.splits), func(i int) bool { return p.splits[i] > key })
+	if n >= r {
+		n = r - 1
+	}
+	return n
+}
+
+// prefixPartitioner hashes only the first n bytes of each key, so keys
+// sharing a prefix go to the same reduce task.
+type prefixPartitioner struct {
+	n int
+}
+
+func newPrefixPartitioner(args []string) (Partitioner, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("prefix partitioner takes the prefix length")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("prefix length %q is not a positive integer", args[0])
+	}
+	return prefixPartitioner{n: n}, nil
+}
+
+func (p prefixPartitioner) Partition(key string, r int) int {
+	if len(key) > p.n {
+		key = key[:p.n]
+	}
+	return hashPartitioner{}.Partition(key, r)
+}
+
+// sampleSize is how many input keys a sorted job samples to pick the split
+// points of its range partitioner.
+const sampleSize = 10000
+
+// splitPoints picks r-1 split points that divide a sorted sample of keys
+// into r ranges of about the same size. The sample is of the job's input
+// keys, so the ranges only balance the reduce tasks well if Map mostly
+// keeps its input keys.
+func splitPoints(sample []string, r int) []string {
+	points := make([]string, 0, r-1)
+	for i := 1; i < r; i++ {
+		if len(sample) == 0 {
+			points = append(points, "")
+			continue
+		}
+		points = append(points, sample[i*len(sample)/r])
+	}
+	return points
+}
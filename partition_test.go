@@ -0,0 +1,118 @@
+package mapreduce
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRangePartitioner(t *testing.T) {
+	p, err := newPartitioner(PartitionerSpec{Name: "range", Args: []string{"g", "p"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"", 0},
+		{"apple", 0},
+		{"f", 0},
+		{"g", 1},
+		{"grape", 1},
+		{"p", 2},
+		{"zebra", 2},
+	}
+	for _, test := range tests {
+		if got := p.Partition(test.key, 3); got != test.want {
+			t.Errorf("Partition(%q, 3) = %d, want %d", test.key, got, test.want)
+		}
+	}
+
+	// more split points than reduce tasks puts the rest in the last one
+	if got := p.Partition("zebra", 2); got != 1 {
+		t.Errorf("Partition(%q, 2) = %d, want 1", "zebra", got)
+	}
+
+	if _, err = newPartitioner(PartitionerSpec{Name: "range", Args: []string{"p", "g"}}); err == nil {
+		t.Errorf("range partitioner accepted unsorted split points")
+	}
+}
+
+func TestPrefixPartitioner(t *testing.T) {
+	p, err := newPartitioner(PartitionerSpec{Name: "prefix", Args: []string{"3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		a, b string
+	}{
+		{"abcdef", "abcxyz"},
+		{"abc", "abc123"},
+		{"ab", "ab"},
+	}
+	for _, test := range tests {
+		for _, r := range []int{1, 2, 7, 16} {
+			pa, pb := p.Partition(test.a, r), p.Partition(test.b, r)
+			if pa != pb {
+				t.Errorf("Partition(%q, %d) = %d but Partition(%q, %d) = %d", test.a, r, pa, test.b, r, pb)
+			}
+			if pa < 0 || pa >= r {
+				t.Errorf("Partition(%q, %d) = %d, out of range", test.a, r, pa)
+			}
+		}
+	}
+
+	for _, args := range [][]string{nil, {"0"}, {"x"}, {"1", "2"}} {
+		if _, err = newPartitioner(PartitionerSpec{Name: "prefix", Args: args}); err == nil {
+			t.Errorf("prefix partitioner accepted %q", args)
+		}
+	}
+}
+
+func TestPartitionerPanic(t *testing.T) {
+	RegisterPartitioner("test-panic", func(args []string) (Partitioner, error) { panic("boom") })
+	if _, err := newPartitioner(PartitionerSpec{Name: "test-panic"}); err == nil {
+		t.Errorf("newPartitioner with a panicking constructor succeeded")
+	}
+}
+
+func TestParsePartitionerSpec(t *testing.T) {
+	tests := []struct {
+		s    string
+		want PartitionerSpec
+	}{
+		{"", PartitionerSpec{}},
+		{"hash", PartitionerSpec{Name: "hash"}},
+		{"prefix:3", PartitionerSpec{Name: "prefix", Args: []string{"3"}}},
+		{"range:g,p", PartitionerSpec{Name: "range", Args: []string{"g", "p"}}},
+	}
+	for _, test := range tests {
+		got := parsePartitionerSpec(test.s)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parsePartitionerSpec(%q) = %+v, want %+v", test.s, got, test.want)
+		}
+		if test.s != "" && got.String() != test.s {
+			t.Errorf("%+v.String() = %q, want %q", got, got.String(), test.s)
+		}
+	}
+}
+
+func TestSplitPoints(t *testing.T) {
+	tests := []struct {
+		sample []string
+		r      int
+		want   []string
+	}{
+		{[]string{"a", "b", "c", "d", "e", "f"}, 3, []string{"c", "e"}},
+		{[]string{"a", "b", "c", "d"}, 2, []string{"c"}},
+		{[]string{"a", "b", "c"}, 1, []string{}},
+		{[]string{"a"}, 3, []string{"a", "a"}},
+		{nil, 3, []string{"", ""}},
+	}
+	for _, test := range tests {
+		got := splitPoints(test.sample, test.r)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitPoints(%q, %d) = %q, want %q", test.sample, test.r, got, test.want)
+		}
+	}
+}
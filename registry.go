@@ -0,0 +1,362 @@
+package mapreduce
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	heartbeatInterval = 2 * time.Second
+	workerTimeout     = 5 * heartbeatInterval
+)
+
+// workerInfo is the master's record of a worker process.
+type workerInfo struct {
+	address        string
+	lastSeen       time.Time
+	alive          bool
+	slots          int            // how many tasks it can run at once
+	tasks          []TaskProgress // tasks it last reported running
+	waiting        int            // its GetTask calls waiting for a task
+	tasksCompleted int
+	failures       int
+	recentFailures []time.Time // failures within the blacklist window, oldest first
+	blacklisted    bool        // no longer handed tasks
+	left           bool        // said goodbye after being told to stop
+}
+
+// ClearArgs names a blacklisted worker to put back to use, or all of them if
+// Address is empty.
+type ClearArgs struct {
+	Address string
+}
+
+type RegisterArgs struct {
+	Address string
+	Slots   int // how many tasks the worker can run at once
+}
+
+type TaskProgress struct {
+	JobID    int
+	Phase    int
+	TaskID   int
+	Attempt  int
+	Progress int64 // input pairs processed so far
+}
+
+type HeartbeatArgs struct {
+	Address string
+	Tasks   []TaskProgress // one per busy slot
+}
+
+type HeartbeatReply struct {
+	Known     bool           // false if the master has no record of the worker
+	Stop      bool           // the master is shutting down
+	Cancelled []int          // jobs that have been cancelled
+	Revoked   []TaskProgress // reported tasks the worker should give up on
+}
+
+func (w *Work) Register(args RegisterArgs, reply *Nothing) error {
+	w.Mux.Lock()
+	defer w.Mux.Unlock()
+	defer w.notify()
+
+	info := w.touch(args.Address)
+	info.slots = args.Slots
+	info.tasks = nil
+	info.left = false
+	log.Printf("worker %s registered with %d slots", args.Address, args.Slots)
+
+	// a worker registers when it starts, so anything an earlier process at
+	// the same address was running is gone, and so are its files
+	w.releaseTasks(args.Address)
+	for _, j := range w.jobs {
+		j.forgetSplits(args.Address)
+	}
+	return nil
+}
+
+func (w *Work) Heartbeat(args HeartbeatArgs, reply *HeartbeatReply) error {
+	w.Mux.Lock()
+	defer w.Mux.Unlock()
+
+	reply.Stop = w.stopping
+	reply.Cancelled = w.cancelledJobs()
+	if info, ok := w.workers[args.Address]; !ok || info.left {
+		return nil
+	}
+	info := w.touch(args.Address)
+	info.tasks = args.Tasks
+	reply.Known = true
+
+	for _, task := range args.Tasks {
+		if w.revoked(args.Address, task) {
+			reply.Revoked = append(reply.Revoked, task)
+		} else {
+			w.renew(args.Address, task)
+		}
+	}
+	return nil
+}
+
+// renew extends the lease on a task a worker says it is still running, so
+// that only tasks whose worker has gone quiet are handed out again. The
+// caller must hold w.Mux.
+func (w *Work) renew(address string, task TaskProgress) {
+	state := w.job(task.JobID).lookup(task.Phase, task.TaskID)
+	if state.status != taskInProgress {
+		return
+	}
+	if state.worker == address && state.attempt == task.Attempt {
+		state.renewed = time.Now()
+	} else if state.backup == address && state.backupAttempt == task.Attempt {
+		state.backupRenewed = time.Now()
+	}
+}
+
+// revoked reports whether a task a worker says it is running is no longer
+// wanted from it: the job is over, or the task has been handed to another
+// worker or finished by another copy. The caller must hold w.Mux.
+func (w *Work) revoked(address string, task TaskProgress) bool {
+	j := w.job(task.JobID)
+	if j == nil || j.phase > 1 {
+		return true
+	}
+	state := j.lookup(task.Phase, task.TaskID)
+	if state == nil {
+		return true
+	}
+	if state.status == taskCompleted {
+		// the worker may be just about to report its own result
+		return state.worker != address
+	}
+	if state.status != taskInProgress {
+		return true
+	}
+	primary := state.worker == address && state.attempt == task.Attempt
+	backup := state.backup == address && state.backupAttempt == task.Attempt
+	return !primary && !backup
+}
+
+// touch records that a worker has been heard from, adding it to the registry
+// if necessary. The caller must hold w.Mux.
+func (w *Work) touch(address string) *workerInfo {
+	info, ok := w.workers[address]
+	if !ok {
+		info = &workerInfo{address: address, slots: 1}
+		w.workers[address] = info
+	} else if !info.alive {
+		log.Printf("worker %s is back", address)
+	}
+	info.alive = true
+	info.lastSeen = time.Now()
+	return info
+}
+
+// monitor periodically declares workers dead when they stop sending
+// heartbeats, and returns their in-progress tasks to the pool. It also wakes
+// up waiting GetTask calls so they notice expired leases and stragglers.
+func (w *Work) monitor() {
+	for range time.Tick(heartbeatInterval) {
+		w.Mux.Lock()
+		w.notify()
+		for _, info := range w.workers {
+			if info.alive && time.Since(info.lastSeen) > workerTimeout {
+				info.alive = false
+				log.Printf("worker %s declared dead, last seen %v ago", info.address, time.Since(info.lastSeen))
+				w.releaseTasks(info.address)
+				for _, j := range w.jobs {
+					j.forget(info.address)
+				}
+			}
+		}
+		w.Mux.Unlock()
+	}
+}
+
+// running counts the tasks the master has handed to a worker that are
+// still running. The caller must hold w.Mux.
+func (w *Work) running(address string) int {
+	n := 0
+	for _, j := range w.jobs {
+		if j.phase > 1 {
+			continue
+		}
+		for _, state := range j.states() {
+			if state.status == taskInProgress && (state.worker == address || state.backup == address) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// usable counts the live workers other than the given one that can be
+// handed tasks. The caller must hold w.Mux.
+func (w *Work) usable(except string) int {
+	n := 0
+	for address, info := range w.workers {
+		if address != except && info.alive && !info.left && !info.blacklisted {
+			n++
+		}
+	}
+	return n
+}
+
+// freeWorkers lists the live workers other than the given one that are
+// waiting for a task with a slot free, and are not blacklisted. The caller
+// must hold w.Mux.
+func (w *Work) freeWorkers(except string) []string {
+	var free []string
+	for address, info := range w.workers {
+		if address == except || info.waiting == 0 || !info.alive || info.left || info.blacklisted {
+			continue
+		}
+		if w.running(address) < info.slots {
+			free = append(free, address)
+		}
+	}
+	return free
+}
+
+// releaseTasks returns every running task held by the given worker to the
+// idle state. The caller must hold w.Mux.
+func (w *Work) releaseTasks(address string) {
+	for _, j := range w.jobs {
+		if j.phase > 1 {
+			continue
+		}
+		for i, state := range j.states() {
+			if state.status != taskInProgress {
+				continue
+			}
+			if state.backup == address {
+				state.backup = ""
+				j.record(j.phase, i)
+			} else if state.worker == address && state.backup != "" {
+				log.Printf("%v: task %d released from %s, keeping the backup copy on %s", j, i, address, state.backup)
+				state.worker = state.backup
+				state.started = state.backupStarted
+				state.renewed = state.backupRenewed
+				state.attempt = state.backupAttempt
+				state.backup = ""
+				w.workerFailed(address)
+				j.record(j.phase, i)
+			} else if state.worker == address {
+				log.Printf("%v: task %d released from %s", j, i, address)
+				state.status = taskIdle
+				w.workerFailed(address)
+				j.record(j.phase, i)
+			}
+		}
+	}
+}
+
+// workerFailed counts a failed or lost task against a worker, and blacklists
+// the worker once it has failed maxFailures times within the failure window.
+// The last usable worker is never blacklisted, so that jobs can still make
+// progress. The caller must hold w.Mux.
+func (w *Work) workerFailed(address string) {
+	info, ok := w.workers[address]
+	if !ok {
+		return
+	}
+	info.failures++
+	now := time.Now()
+	info.recentFailures = append(info.recentFailures, now)
+	for now.Sub(info.recentFailures[0]) > w.failureWindow {
+		info.recentFailures = info.recentFailures[1:]
+	}
+	if w.maxFailures <= 0 || info.blacklisted || len(info.recentFailures) < w.maxFailures {
+		return
+	}
+
+	if w.usable(address) == 0 {
+		log.Printf("worker %s failed %d times within %v, but it is the only worker left", address, len(info.recentFailures), w.failureWindow)
+		return
+	}
+	info.blacklisted = true
+	log.Printf("worker %s blacklisted after %d failures within %v", address, len(info.recentFailures), w.failureWindow)
+}
+
+// ClearBlacklist lets the master hand tasks to blacklisted workers again,
+// and forgets their recent failures. It replies with the number of workers
+// taken off the blacklist.
+func (w *Work) ClearBlacklist(args ClearArgs, cleared *int) error {
+	w.Mux.Lock()
+	defer w.Mux.Unlock()
+	defer w.notify()
+
+	if args.Address != "" {
+		if _, ok := w.workers[args.Address]; !ok {
+			return fmt.Errorf("no worker %s", args.Address)
+		}
+	}
+	*cleared = 0
+	for address, info := range w.workers {
+		if args.Address != "" && address != args.Address {
+			continue
+		}
+		if info.blacklisted {
+			log.Printf("worker %s taken off the blacklist", address)
+			*cleared++
+		}
+		info.blacklisted = false
+		info.recentFailures = nil
+	}
+	return nil
+}
+
+// heartbeat registers the worker with the master and then reports its
+// liveness and current tasks until quit is closed.
+func heartbeat(master *masterConn, address string, ws *workerStatus, quit <-chan struct{}) {
+	register := func() {
+		args := RegisterArgs{Address: address, Slots: len(ws.slots)}
+		if err := master.try("Work.Register", args, new(Nothing)); err != nil {
+			log.Printf("Work.Register: %v", err)
+		}
+	}
+
+	register()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+		var args HeartbeatArgs
+		args.Address = address
+		for _, status := range ws.slots {
+			taskID := atomic.LoadInt64(&status.taskID)
+			if taskID < 0 {
+				continue
+			}
+			args.Tasks = append(args.Tasks, TaskProgress{
+				JobID:    int(atomic.LoadInt64(&status.job)),
+				Phase:    int(atomic.LoadInt64(&status.phase)),
+				TaskID:   int(taskID),
+				Attempt:  int(atomic.LoadInt64(&status.attempt)),
+				Progress: atomic.LoadInt64(&status.counters.processed),
+			})
+		}
+		var reply HeartbeatReply
+		err := master.try("Work.Heartbeat", args, &reply)
+		if err != nil {
+			log.Printf("Work.Heartbeat: %v", err)
+			continue
+		}
+		ws.cancelJobs(reply.Cancelled)
+		ws.revoke(reply.Revoked)
+		if reply.Stop {
+			ws.stop()
+			return
+		}
+		if !reply.Known {
+			register()
+		}
+	}
+}
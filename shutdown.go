@@ -0,0 +1,79 @@
+package mapreduce
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout is how long a stopping master waits for its workers to
+// say goodbye before closing its server anyway.
+const shutdownTimeout = 10 * time.Second
+
+// Shutdown asks the master to tell its workers to stop and then exit.
+func (w *Work) Shutdown(args Nothing, reply *Nothing) error {
+	w.Mux.Lock()
+	defer w.Mux.Unlock()
+	w.stop()
+	return nil
+}
+
+// Goodbye is called by a worker that has been told to stop, just before
+// it exits.
+func (w *Work) Goodbye(args RegisterArgs, reply *Nothing) error {
+	w.Mux.Lock()
+	defer w.Mux.Unlock()
+	info := w.touch(args.Address)
+	info.alive = false
+	info.left = true
+	log.Printf("worker %s said goodbye", args.Address)
+	return nil
+}
+
+// stop starts shutting the master down. From now on workers are told to
+// stop whenever they ask for a task or send a heartbeat. The caller must
+// hold w.Mux.
+func (w *Work) stop() {
+	if w.stopping {
+		return
+	}
+	log.Println("shutting down, telling workers to stop")
+	w.stopping = true
+	close(w.stopped)
+	w.notify()
+}
+
+// waitForWorkers waits until every live worker has said goodbye, or until
+// the shutdown timeout expires.
+func (w *Work) waitForWorkers() {
+	deadline := time.Now().Add(shutdownTimeout)
+	for {
+		w.Mux.Lock()
+		var waiting []string
+		for _, info := range w.workers {
+			if info.alive {
+				waiting = append(waiting, info.address)
+			}
+		}
+		w.Mux.Unlock()
+
+		if len(waiting) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("gave up waiting for workers %v", waiting)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// closeServer stops an HTTP server, letting requests in flight finish.
+func closeServer(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down HTTP server for %s: %v", srv.Addr, err)
+	}
+}
@@ -0,0 +1,114 @@
+package mapreduce
+
+import (
+	"fmt"
+	"sort"
+)
+
+// StatusReply describes what a master is doing, for the -status command.
+type StatusReply struct {
+	Jobs    []JobReport
+	Workers []WorkerReport
+}
+
+type JobReport struct {
+	ID          int
+	Name        string
+	Phase       int // 0 map, 1 reduce, 2 over
+	M, R        int
+	MapsDone    int
+	ReducesDone int
+	Error       string           // why the job failed, if it did
+	Counters    map[string]int64 // totals over the finished tasks
+}
+
+type WorkerReport struct {
+	Address        string
+	Alive          bool
+	Slots          int
+	TasksCompleted int
+	Failures       int
+	Blacklisted    bool
+	Tasks          []TaskProgress // what it last reported running
+}
+
+// Status reports on the master's jobs and workers.
+func (w *Work) Status(args Nothing, reply *StatusReply) error {
+	w.Mux.Lock()
+	defer w.Mux.Unlock()
+
+	for _, j := range w.jobs {
+		report := JobReport{
+			ID:          j.id,
+			Name:        j.spec.Name,
+			Phase:       j.phase,
+			M:           j.spec.M,
+			R:           j.spec.R,
+			MapsDone:    countCompleted(j.mapStates),
+			ReducesDone: countCompleted(j.reduceStates),
+			Counters:    make(map[string]int64),
+		}
+		if j.err != nil {
+			report.Error = j.err.Error()
+		}
+		for name, n := range j.counters {
+			report.Counters[name] = n
+		}
+		reply.Jobs = append(reply.Jobs, report)
+	}
+
+	for _, info := range w.workers {
+		reply.Workers = append(reply.Workers, WorkerReport{
+			Address:        info.address,
+			Alive:          info.alive,
+			Slots:          info.slots,
+			TasksCompleted: info.tasksCompleted,
+			Failures:       info.failures,
+			Blacklisted:    info.blacklisted,
+			Tasks:          append([]TaskProgress(nil), info.tasks...),
+		})
+	}
+	sort.Slice(reply.Workers, func(a, b int) bool { return reply.Workers[a].Address < reply.Workers[b].Address })
+	return nil
+}
+
+// printStatus writes a status report to standard output.
+func printStatus(status StatusReply) {
+	fmt.Println("jobs:")
+	for _, j := range status.Jobs {
+		name := fmt.Sprintf("job %d", j.ID)
+		if j.Name != "" {
+			name += " (" + j.Name + ")"
+		}
+		state := [...]string{"mapping", "reducing", "finished"}[j.Phase]
+		if j.Error != "" {
+			state = "failed: " + j.Error
+		}
+		fmt.Printf("  %s: %s, %d/%d maps, %d/%d reduces done\n", name, state, j.MapsDone, j.M, j.ReducesDone, j.R)
+		if len(j.Counters) > 0 {
+			fmt.Printf("    %s\n", formatCounters(j.Counters))
+		}
+	}
+
+	var blacklist []string
+	fmt.Println("workers:")
+	for _, info := range status.Workers {
+		state := "alive"
+		if !info.Alive {
+			state = "dead"
+		}
+		if info.Blacklisted {
+			state += ", blacklisted"
+			blacklist = append(blacklist, info.Address)
+		}
+		fmt.Printf("  %s: %s, %d slots, %d tasks completed, %d failures\n", info.Address, state, info.Slots, info.TasksCompleted, info.Failures)
+		for _, task := range info.Tasks {
+			kind := "map"
+			if task.Phase == 1 {
+				kind = "reduce"
+			}
+			fmt.Printf("    job %d %s task %d: %d pairs processed\n", task.JobID, kind, task.TaskID, task.Progress)
+		}
+	}
+	fmt.Printf("blacklist: %v\n", blacklist)
+}
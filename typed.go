@@ -0,0 +1,189 @@
+package mapreduce
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// A Codec turns values of type T into the strings stored in pairs, and back.
+type Codec[T any] interface {
+	Encode(v T) (string, error)
+	Decode(s string) (T, error)
+}
+
+// StringCodec stores strings as they are.
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) (string, error) { return v, nil }
+func (StringCodec) Decode(s string) (string, error) { return s, nil }
+
+// JSONCodec stores values as JSON. Numbers come out in decimal, so a
+// JSONCodec[int] reads and writes the same pairs as strconv does.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (JSONCodec[T]) Decode(s string) (T, error) {
+	var v T
+	err := json.Unmarshal([]byte(s), &v)
+	return v, err
+}
+
+// GobCodec stores values with encoding/gob. Every value carries its own type
+// description, so it suits structured values better than small ones.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) (string, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.String(), err
+}
+
+func (GobCodec[T]) Decode(s string) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader([]byte(s))).Decode(&v)
+	return v, err
+}
+
+// BinaryCodec stores fixed-size values, such as numbers and structs of them,
+// with encoding/binary in big-endian order, so that unsigned integers sort
+// bytewise in numeric order.
+type BinaryCodec[T any] struct{}
+
+func (BinaryCodec[T]) Encode(v T) (string, error) {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.BigEndian, v)
+	return buf.String(), err
+}
+
+func (BinaryCodec[T]) Decode(s string) (T, error) {
+	var v T
+	err := binary.Read(bytes.NewReader([]byte(s)), binary.BigEndian, &v)
+	return v, err
+}
+
+// Mapper is a Map function on typed keys and values. It calls emit for each
+// output pair.
+type Mapper[KIn, VIn, KOut, VOut any] interface {
+	Map(ctx context.Context, key KIn, value VIn, emit func(KOut, VOut) error) error
+}
+
+// Reducer is a Reduce function on typed keys and values. It calls emit for
+// each output pair.
+type Reducer[K, VIn, KOut, VOut any] interface {
+	Reduce(ctx context.Context, key K, values <-chan VIn, emit func(KOut, VOut) error) error
+}
+
+// Typed is a client made of a typed Mapper and Reducer and the codecs for
+// their keys and values: the input's (KIn, VIn), the map output's (KMid,
+// VMid) and the reduce output's (KOut, VOut). It implements both Interface
+// and ContextInterface, so it can be passed to Start or StartContext. If the
+// Mapper or Reducer implements SetupInterface or TeardownInterface, it is
+// set up and torn down around its tasks.
+type Typed[KIn, VIn, KMid, VMid, KOut, VOut any] struct {
+	Mapper  Mapper[KIn, VIn, KMid, VMid]
+	Reducer Reducer[KMid, VMid, KOut, VOut]
+
+	InKey    Codec[KIn]
+	InValue  Codec[VIn]
+	MidKey   Codec[KMid]
+	MidValue Codec[VMid]
+	OutKey   Codec[KOut]
+	OutValue Codec[VOut]
+}
+
+func (t *Typed[KIn, VIn, KMid, VMid, KOut, VOut]) Map(key, value string, output chan<- Pair) error {
+	return t.MapContext(context.Background(), key, value, output)
+}
+
+func (t *Typed[KIn, VIn, KMid, VMid, KOut, VOut]) Reduce(key string, values <-chan string, output chan<- Pair) error {
+	return t.ReduceContext(context.Background(), key, values, output)
+}
+
+func (t *Typed[KIn, VIn, KMid, VMid, KOut, VOut]) MapContext(ctx context.Context, key, value string, output chan<- Pair) error {
+	defer close(output)
+	k, err := t.InKey.Decode(key)
+	if err != nil {
+		return fmt.Errorf("decoding key: %v", err)
+	}
+	v, err := t.InValue.Decode(value)
+	if err != nil {
+		return fmt.Errorf("decoding value: %v", err)
+	}
+	return t.Mapper.Map(ctx, k, v, emitter(t.MidKey, t.MidValue, output))
+}
+
+func (t *Typed[KIn, VIn, KMid, VMid, KOut, VOut]) ReduceContext(ctx context.Context, key string, values <-chan string, output chan<- Pair) error {
+	defer close(output)
+	k, err := t.MidKey.Decode(key)
+	if err != nil {
+		return fmt.Errorf("decoding key: %v", err)
+	}
+
+	// decode the values as the Reducer reads them; done stops the decoding
+	// if the Reducer returns early
+	typed := make(chan VMid)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	decodeErr := make(chan error, 1)
+	go func() {
+		defer close(exited)
+		defer close(typed)
+		for value := range values {
+			v, err := t.MidValue.Decode(value)
+			if err != nil {
+				decodeErr <- fmt.Errorf("decoding value: %v", err)
+				return
+			}
+			select {
+			case typed <- v:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = t.Reducer.Reduce(ctx, k, typed, emitter(t.OutKey, t.OutValue, output))
+	close(done)
+	<-exited
+	select {
+	case derr := <-decodeErr:
+		if err == nil {
+			err = derr
+		}
+	default:
+	}
+	return err
+}
+
+// emitter returns an emit function that encodes pairs onto output.
+func emitter[K, V any](keys Codec[K], values Codec[V], output chan<- Pair) func(K, V) error {
+	return func(k K, v V) error {
+		key, err := keys.Encode(k)
+		if err != nil {
+			return fmt.Errorf("encoding key: %v", err)
+		}
+		value, err := values.Encode(v)
+		if err != nil {
+			return fmt.Errorf("encoding value: %v", err)
+		}
+		output <- Pair{Key: key, Value: value}
+		return nil
+	}
+}
+
+// phasePart returns the Mapper for a map task and the Reducer for a reduce
+// task, which is where setupTask looks for Setup and Teardown.
+func (t *Typed[KIn, VIn, KMid, VMid, KOut, VOut]) phasePart(phase int) interface{} {
+	if phase == 0 {
+		return t.Mapper
+	}
+	return t.Reducer
+}
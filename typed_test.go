@@ -0,0 +1,168 @@
+package mapreduce
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X, Y int32
+}
+
+// roundTrip encodes and decodes each value with codec, and checks it comes
+// back the same.
+func roundTrip[T any](t *testing.T, name string, codec Codec[T], values []T) {
+	t.Helper()
+	for _, v := range values {
+		s, err := codec.Encode(v)
+		if err != nil {
+			t.Errorf("%s: Encode(%v): %v", name, v, err)
+			continue
+		}
+		got, err := codec.Decode(s)
+		if err != nil {
+			t.Errorf("%s: Decode(%q): %v", name, s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Errorf("%s: round trip of %v gave %v", name, v, got)
+		}
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	roundTrip[string](t, "StringCodec", StringCodec{}, []string{"", "hello", "tab\there"})
+	roundTrip[int](t, "JSONCodec[int]", JSONCodec[int]{}, []int{0, -7, 1 << 40})
+	roundTrip[[]string](t, "JSONCodec[[]string]", JSONCodec[[]string]{}, [][]string{{"a", "b"}, {}})
+	roundTrip[point](t, "GobCodec[point]", GobCodec[point]{}, []point{{1, 2}, {-3, 0}})
+	roundTrip[uint64](t, "BinaryCodec[uint64]", BinaryCodec[uint64]{}, []uint64{0, 1, 1 << 63})
+	roundTrip[point](t, "BinaryCodec[point]", BinaryCodec[point]{}, []point{{1, 2}, {-3, 0}})
+}
+
+func TestJSONCodecDecimal(t *testing.T) {
+	s, err := JSONCodec[int]{}.Encode(42)
+	if err != nil || s != "42" {
+		t.Errorf("JSONCodec[int].Encode(42) = %q, %v, want \"42\"", s, err)
+	}
+}
+
+func TestBinaryCodecOrder(t *testing.T) {
+	values := []uint64{300, 2, 1 << 40, 0, 65536}
+	var encoded []string
+	for _, v := range values {
+		s, err := BinaryCodec[uint64]{}.Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, s)
+	}
+	sort.Strings(encoded)
+	var got []uint64
+	for _, s := range encoded {
+		v, err := BinaryCodec[uint64]{}.Decode(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, v)
+	}
+	want := []uint64{0, 2, 300, 65536, 1 << 40}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bytewise order of encoded values = %v, want %v", got, want)
+	}
+}
+
+func TestCodecDecodeErrors(t *testing.T) {
+	if _, err := (JSONCodec[int]{}).Decode("seven"); err == nil {
+		t.Errorf("JSONCodec[int] decoded %q", "seven")
+	}
+	if _, err := (BinaryCodec[uint64]{}).Decode("abc"); err == nil {
+		t.Errorf("BinaryCodec[uint64] decoded a 3-byte string")
+	}
+	if _, err := (GobCodec[point]{}).Decode("not gob"); err == nil {
+		t.Errorf("GobCodec[point] decoded %q", "not gob")
+	}
+}
+
+// wordLengths maps each word of a line to its length, and sums the lengths
+// of each word.
+type wordLengths struct{}
+
+func (wordLengths) Map(ctx context.Context, line int, text string, emit func(string, int) error) error {
+	for _, word := range strings.Fields(text) {
+		if err := emit(word, len(word)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wordLengths) Reduce(ctx context.Context, word string, lengths <-chan int, emit func(string, int) error) error {
+	total := 0
+	for n := range lengths {
+		total += n
+	}
+	return emit(word, total)
+}
+
+func TestTyped(t *testing.T) {
+	typed := &Typed[int, string, string, int, string, int]{
+		Mapper:   wordLengths{},
+		Reducer:  wordLengths{},
+		InKey:    JSONCodec[int]{},
+		InValue:  StringCodec{},
+		MidKey:   StringCodec{},
+		MidValue: JSONCodec[int]{},
+		OutKey:   StringCodec{},
+		OutValue: JSONCodec[int]{},
+	}
+
+	output := make(chan Pair)
+	errs := make(chan error, 1)
+	go func() { errs <- typed.Map("1", "to be or", output) }()
+	var got []Pair
+	for pair := range output {
+		got = append(got, pair)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Map: %v", err)
+	}
+	want := []Pair{{"to", "2"}, {"be", "2"}, {"or", "2"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Map = %v, want %v", got, want)
+	}
+
+	values := make(chan string, 3)
+	values <- "2"
+	values <- "2"
+	values <- "3"
+	close(values)
+	output = make(chan Pair)
+	go func() { errs <- typed.Reduce("to", values, output) }()
+	got = nil
+	for pair := range output {
+		got = append(got, pair)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Reduce: %v", err)
+	}
+	want = []Pair{{"to", "7"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Reduce = %v, want %v", got, want)
+	}
+
+	// a value that doesn't decode fails the Reduce call rather than
+	// reaching the Reducer
+	values = make(chan string, 1)
+	values <- "x"
+	close(values)
+	output = make(chan Pair)
+	go func() { errs <- typed.Reduce("to", values, output) }()
+	for range output {
+	}
+	if err := <-errs; err == nil {
+		t.Errorf("Reduce with an undecodable value succeeded")
+	}
+}
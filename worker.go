@@ -1,27 +1,39 @@
 package mapreduce
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"hash/fnv"
 	"log"
 	"net/http"
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type MapTask struct {
-	M, R       int    // total number of map and reduce tasks
-	N          int    // map task number, 0-based
-	SourceHost string // address of host with map input file
+	Job         int               // ID of the job the task belongs to
+	M, R        int               // total number of map and reduce tasks
+	N           int               // map task number, 0-based
+	SourceHost  string            // address of host with map input file
+	Skip        []string          // input keys to leave out, because Map fails on them
+	Config      map[string]string // the job's configuration
+	Partitioner PartitionerSpec   // decides which reduce task gets each output pair
 }
 
 type ReduceTask struct {
-	M, R        int      // total number of map and reduce tasks
-	N           int      // reduce task number, 0-based
-	SourceHosts []string // addresses of map workers
+	Job         int               // ID of the job the task belongs to
+	M, R        int               // total number of map and reduce tasks
+	N           int               // reduce task number, 0-based
+	SourceHosts []string          // addresses of map workers
+	Skip        []string          // keys to leave out, because Reduce fails on them
+	Config      map[string]string // the job's configuration
+	Sort        SortSpec          // how keys and values are ordered and grouped
 }
 
 type Pair struct {
@@ -29,31 +41,180 @@ type Pair struct {
 	Value string
 }
 
+// taskStatus is what one of a worker's task slots is doing, as reported in
+// its heartbeats. The fields are accessed atomically.
+type taskStatus struct {
+	job      int64
+	phase    int64
+	taskID   int64 // -1 when idle
+	attempt  int64
+	counters taskCounters
+
+	mu     sync.Mutex         // held while the task changes, and to abort it
+	cancel context.CancelFunc // aborts the running task
+}
+
+// taskCounters are tallies kept while a task runs, and reported to the
+// master when it finishes. The fields are accessed atomically.
+type taskCounters struct {
+	processed   int64 // input pairs processed
+	skipped     int64 // input pairs left out because their key is skipped
+	combineIn   int64 // map output pairs given to Combine
+	combineOut  int64 // pairs Combine produced in their place
+	localBytes  int64 // input bytes read from the worker's own disk
+	remoteBytes int64 // input bytes fetched from other hosts
+}
+
+// taskRun is what a task needs to know about the worker running it.
+type taskRun struct {
+	dir      string // where the task's files go, ending in a slash
+	address  string // the worker's own address
+	attempt  int
+	counters *taskCounters
+}
+
+// workerStatus is what a worker reports in its heartbeats, and what it has
+// been told about cancelled jobs.
+type workerStatus struct {
+	slots    []*taskStatus
+	stopping int64  // set once the master has asked the worker to stop
+	tempdir  string // holds a directory for each job's files
+
+	mu        sync.Mutex
+	cancelled map[int]bool // jobs the master has cancelled
+}
+
+// masterRetry is how long a worker keeps trying to reach the master before
+// giving up.
+const masterRetry = time.Minute
+
 type Interface interface {
 	Map(key, value string, output chan<- Pair) error
 	Reduce(key string, values <-chan string, output chan<- Pair) error
 }
 
-func (task *MapTask) Process(tempdir string, client Interface) error {
+// ContextInterface is like Interface, but Map and Reduce are given a context
+// that is cancelled when the master revokes the task, because it timed out,
+// another copy finished first, or its job was cancelled. Long-running calls
+// should return promptly once it is done.
+type ContextInterface interface {
+	MapContext(ctx context.Context, key, value string, output chan<- Pair) error
+	ReduceContext(ctx context.Context, key string, values <-chan string, output chan<- Pair) error
+}
+
+// TaskInfo describes the task a client is running. It is passed to Setup,
+// and can be had from the context given to MapContext and ReduceContext with
+// TaskInfoFromContext.
+type TaskInfo struct {
+	Job     int               // ID of the job the task belongs to
+	Phase   int               // 0 for a map task, 1 for a reduce task
+	N       int               // task number, 0-based
+	M, R    int               // total number of map and reduce tasks
+	Attempt int               // which copy of the task this is, starting from 1
+	Config  map[string]string // the job's configuration, as given when it was submitted
+}
+
+type taskInfoKey struct{}
+
+// TaskInfoFromContext returns the TaskInfo of the task a MapContext or
+// ReduceContext call belongs to.
+func TaskInfoFromContext(ctx context.Context) (TaskInfo, bool) {
+	info, ok := ctx.Value(taskInfoKey{}).(TaskInfo)
+	return info, ok
+}
+
+func (task *MapTask) info(run *taskRun) TaskInfo {
+	return TaskInfo{Job: task.Job, Phase: 0, N: task.N, M: task.M, R: task.R, Attempt: run.attempt, Config: task.Config}
+}
+
+func (task *ReduceTask) info(run *taskRun) TaskInfo {
+	return TaskInfo{Job: task.Job, Phase: 1, N: task.N, M: task.M, R: task.R, Attempt: run.attempt, Config: task.Config}
+}
+
+// SetupInterface is implemented by clients that want to prepare for each
+// task, for example to load a dictionary once rather than for every row.
+// Setup is called before the first Map or Reduce call of a task, and an
+// error fails the task. With several slots, tasks are set up concurrently.
+type SetupInterface interface {
+	Setup(info TaskInfo) error
+}
+
+// TeardownInterface is implemented by clients that want to clean up after
+// each task. Teardown is called once the task's Map or Reduce calls are
+// done, if Setup succeeded. An error fails the task.
+type TeardownInterface interface {
+	Teardown() error
+}
+
+// CombineInterface is implemented by clients that can shrink the output of
+// a map task before it is shuffled, typically by doing part of the reduce's
+// work: Combine is called for each key of each partition with all of that
+// key's values, and its output pairs take their place. Like Reduce, it must
+// close output when done, and it must not change keys in a way that would
+// move pairs to another partition.
+type CombineInterface interface {
+	Combine(key string, values <-chan string, output chan<- Pair) error
+}
+
+// contextAdapter runs an Interface as a ContextInterface, ignoring the
+// context.
+type contextAdapter struct {
+	client Interface
+}
+
+func (a contextAdapter) MapContext(ctx context.Context, key, value string, output chan<- Pair) error {
+	return a.client.Map(key, value, output)
+}
+
+func (a contextAdapter) ReduceContext(ctx context.Context, key string, values <-chan string, output chan<- Pair) error {
+	return a.client.Reduce(key, values, output)
+}
+
+func (task *MapTask) Process(ctx context.Context, run *taskRun, client ContextInterface) error {
 	pairsProcessed := 0
 	pairsGenerated := 0
-	//download and open input file
-	err := download(makeURL(task.SourceHost, mapSourceFile(task.N)), tempdir+mapInputFile(task.N))
-	if err != nil {
-		log.Fatal(err)
+	// the master sends us back to our own copy of the input if we have one,
+	// otherwise download it
+	if task.SourceHost == run.address {
+		info, err := os.Stat(run.dir + mapInputFile(task.N))
+		if err != nil {
+			return fmt.Errorf("reading local map input: %v", err)
+		}
+		run.counters.add(info.Size(), true)
+	} else {
+		n, err := download(ctx, makeURL(task.SourceHost, jobFile(task.Job, mapSourceFile(task.N))), run.dir+mapInputFile(task.N))
+		if err != nil {
+			return fmt.Errorf("downloading map input: %v", err)
+		}
+		run.counters.add(n, false)
 	}
-	sourceDB, err := openDatabase(tempdir + mapInputFile(task.N))
+	sourceDB, err := openDatabase(run.dir + mapInputFile(task.N))
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("opening map input: %v", err)
 	}
 	defer sourceDB.Close()
 
-	// create output files
+	// create output files. With a combiner the map output is written to
+	// temporary files first, and combined into the real ones at the end
+	partitioner, err := newPartitioner(task.Partitioner)
+	if err != nil {
+		return err
+	}
+	combiner, combining := userClient(client).(CombineInterface)
+	outputFile := mapOutputFile
+	if combining {
+		outputFile = mapUncombinedFile
+	}
 	outputDBs := make([]*sql.DB, 0)
+	defer func() {
+		for _, elt := range outputDBs {
+			elt.Close()
+		}
+	}()
 	for r := 0; r < task.R; r++ {
-		db, err := createDatabase(tempdir + mapOutputFile(task.N, r))
+		db, err := createDatabase(run.dir + outputFile(task.N, r))
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("creating map output: %v", err)
 		}
 		outputDBs = append(outputDBs, db)
 	}
@@ -61,209 +222,843 @@ func (task *MapTask) Process(tempdir string, client Interface) error {
 	// run a database query to select all pairs from the source file
 	rows, err := sourceDB.Query("select key, value from pairs")
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("reading map input: %v", err)
 	}
 	defer rows.Close()
 
+	info := task.info(run)
+	ctx = context.WithValue(ctx, taskInfoKey{}, info)
+	teardown, err := setupTask(client, info)
+	if err != nil {
+		return fmt.Errorf("setting up map task: %v", err)
+	}
+	defer teardown()
+
+	skip := skipSet(task.Skip)
 	var key string
 	var value string
 	for rows.Next() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
 		c := make(chan Pair)
 		finished := make(chan error)
 		go func() {
+			// keep draining c after a failed insert so that Map can return
+			var err error
 			for pair := range c {
+				if err != nil {
+					continue
+				}
 				pairsGenerated++
 
-				hash := fnv.New32()
-				hash.Write([]byte(pair.Key))
-				r := int(hash.Sum32()) % task.R
-				tx, err := outputDBs[r].Begin()
+				var r int
+				err = protect(func() error {
+					r = partitioner.Partition(pair.Key, task.R)
+					return nil
+				})
 				if err != nil {
-					log.Fatal(err)
+					err = fmt.Errorf("partitioner %v on key %q: %v", task.Partitioner, pair.Key, err)
+					continue
 				}
-				_, err = tx.Exec("insert into pairs(key, value) values(?, ?)", pair.Key, pair.Value)
-				if err != nil {
-					fmt.Errorf("Insert failed in map inserts %e", err)
+				if r < 0 || r >= task.R {
+					err = fmt.Errorf("partitioner %v put key %q in partition %d of %d", task.Partitioner, pair.Key, r, task.R)
+					continue
 				}
-				tx.Commit()
-
+				err = insertPair(outputDBs[r], pair)
 			}
-			finished <- nil
+			finished <- err
 		}()
 		err = rows.Scan(&key, &value)
 		if err != nil {
-			log.Printf("key error")
+			close(c)
+			<-finished
+			return fmt.Errorf("reading map input: %v", err)
 		}
 
 		pairsProcessed++
-		err = client.Map(key, value, c)
-		if err != nil {
-			log.Fatalf("error calling client map: %v", err)
+		atomic.AddInt64(&run.counters.processed, 1)
+		if skip[key] {
+			close(c)
+			<-finished
+			atomic.AddInt64(&run.counters.skipped, 1)
+			continue
 		}
-		// wait for err to come  back
+		mapErr := callMap(ctx, client, key, value, c)
+		// wait for the output pairs to be written
 		err = <-finished
+		if mapErr != nil {
+			return &keyError{op: "map", key: key, err: mapErr}
+		}
 		if err != nil {
-			log.Fatalf("error calling client map: %v", err)
+			return fmt.Errorf("writing map output: %v", err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("reading map input: %v", err)
+	}
+	if combining {
+		for r, db := range outputDBs {
+			err = combine(ctx, combiner, db, run.dir+mapOutputFile(task.N, r), run.counters)
+			if err != nil {
+				return fmt.Errorf("combining map output: %v", err)
+			}
+			os.Remove(run.dir + mapUncombinedFile(task.N, r))
 		}
-		//insert pairs sent back through the output database
 	}
-	for _, elt := range outputDBs {
-		elt.Close()
+	if err = teardown(); err != nil {
+		return fmt.Errorf("tearing down map task: %v", err)
 	}
 
 	log.Printf("map tasks processed %v pairs, generated %v pairs", pairsProcessed, pairsGenerated)
 	return nil
 }
 
-func launchReduceGoRoutines(values chan string, finished chan error, key string, client Interface, outputDB *sql.DB) {
+// keyError is an error returned by Map or Reduce, with the key it was given,
+// so that the master can have the key skipped when the task is retried.
+type keyError struct {
+	op  string // map or reduce
+	key string
+	err error
+}
+
+func (e *keyError) Error() string {
+	return fmt.Sprintf("%s on key %q: %v", e.op, e.key, e.err)
+}
+
+// skipSet returns the keys of a task's Skip list as a set.
+func skipSet(keys []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, key := range keys {
+		set[key] = true
+	}
+	return set
+}
+
+// combine runs a combiner over the pairs in input, one key at a time, and
+// writes what it produces to a new database at path.
+func combine(ctx context.Context, combiner CombineInterface, input *sql.DB, path string, counters *taskCounters) error {
+	outputDB, err := createDatabase(path)
+	if err != nil {
+		return err
+	}
+	defer outputDB.Close()
+
+	rows, err := input.Query("select key, value from pairs order by key")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var key, value string
+	var pKey string
+	var values []string
+	flush := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		atomic.AddInt64(&counters.combineIn, int64(len(values)))
+		err := combineKey(combiner, pKey, values, outputDB, counters)
+		values = values[:0]
+		return err
+	}
+	for rows.Next() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		if key != pKey {
+			if err = flush(); err != nil {
+				return err
+			}
+			pKey = key
+		}
+		values = append(values, value)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// combineKey calls Combine for one key and writes its output.
+func combineKey(combiner CombineInterface, key string, values []string, outputDB *sql.DB, counters *taskCounters) error {
+	in := make(chan string, len(values))
+	for _, value := range values {
+		in <- value
+	}
+	close(in)
+
 	output := make(chan Pair)
-	go client.Reduce(key, values, output)
-	for pair := range output {
+	combineErr := make(chan error, 1)
+	go func() {
+		combineErr <- protect(func() error {
+			defer closeQuietly(output)
+			return combiner.Combine(key, in, output)
+		})
+	}()
 
-		tx, err := outputDB.Begin()
+	// keep draining output after a failed insert so that Combine can return
+	var err error
+	for pair := range output {
 		if err != nil {
-			finished <- err
+			continue
+		}
+		atomic.AddInt64(&counters.combineOut, 1)
+		err = insertPair(outputDB, pair)
+	}
+	if cerr := <-combineErr; cerr != nil {
+		// not a keyError: skipping map input keys would not help
+		return fmt.Errorf("combine on key %q: %v", key, cerr)
+	}
+	return err
+}
+
+// panicError is a panic recovered from a client's Map or Reduce. Its stack
+// is logged where it is recovered, and left out of the error the master sees.
+type panicError struct {
+	key   string
+	value interface{}
+}
+
+func (e *panicError) Error() string {
+	if e.key == "" {
+		return fmt.Sprintf("panic: %v", e.value)
+	}
+	return fmt.Sprintf("panic on key %q: %v", e.key, e.value)
+}
+
+// callMap runs the client's Map, turning a panic into an error. The output
+// channel is closed on a panic, so that whoever is reading it can finish.
+func callMap(ctx context.Context, client ContextInterface, key, value string, output chan<- Pair) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = &panicError{key: key, value: p}
+			log.Printf("map on key %q panicked: %v\n%s", key, p, debug.Stack())
+			closeQuietly(output)
+		}
+	}()
+	return client.MapContext(ctx, key, value, output)
+}
+
+// callReduce is callMap for Reduce.
+func callReduce(ctx context.Context, client ContextInterface, key string, values <-chan string, output chan<- Pair) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = &panicError{key: key, value: p}
+			log.Printf("reduce on key %q panicked: %v\n%s", key, p, debug.Stack())
+			closeQuietly(output)
+		}
+	}()
+	return client.ReduceContext(ctx, key, values, output)
+}
+
+// userClient returns the client the user passed to Start or StartContext,
+// which is where any optional methods are.
+func userClient(client ContextInterface) interface{} {
+	if adapter, ok := client.(contextAdapter); ok {
+		return adapter.client
+	}
+	return client
+}
+
+// phaseParts is implemented by clients made of separate parts for the map
+// and reduce phases, such as Typed. The optional methods of a task's client
+// are looked for on the part for its phase.
+type phaseParts interface {
+	phasePart(phase int) interface{}
+}
+
+// setupTask calls the client's Setup for a task if it has one, and returns
+// a function that calls its Teardown. The function may be called more than
+// once, but only calls Teardown the first time.
+func setupTask(client ContextInterface, info TaskInfo) (func() error, error) {
+	c := userClient(client)
+	if parts, ok := c.(phaseParts); ok {
+		c = parts.phasePart(info.Phase)
+	}
+	if s, ok := c.(SetupInterface); ok {
+		if err := protect(func() error { return s.Setup(info) }); err != nil {
+			return nil, err
+		}
+	}
+	done := false
+	return func() error {
+		if done {
+			return nil
+		}
+		done = true
+		if t, ok := c.(TeardownInterface); ok {
+			return protect(t.Teardown)
+		}
+		return nil
+	}, nil
+}
+
+// protect runs f, turning a panic into an error.
+func protect(f func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = &panicError{value: p}
+			log.Printf("panicked: %v\n%s", p, debug.Stack())
 		}
-		_, err = tx.Exec("insert into pairs(key, value) values(?, ?)", pair.Key, pair.Value)
+	}()
+	return f()
+}
+
+// closeQuietly closes a channel the client may already have closed.
+func closeQuietly(c chan<- Pair) {
+	defer func() { recover() }()
+	close(c)
+}
+
+func launchReduceGoRoutines(ctx context.Context, values chan string, finished chan error, key string, client ContextInterface, outputDB *sql.DB) {
+	output := make(chan Pair)
+	reduceErr := make(chan error, 1)
+	go func() {
+		reduceErr <- callReduce(ctx, client, key, values, output)
+	}()
+
+	// keep draining output after a failed insert so that Reduce can return
+	var err error
+	for pair := range output {
 		if err != nil {
-			finished <- err
+			continue
 		}
-		tx.Commit()
+		err = insertPair(outputDB, pair)
 	}
-	finished <- nil
+	if rerr := <-reduceErr; rerr != nil {
+		err = &keyError{op: "reduce", key: key, err: rerr}
+	} else if err != nil {
+		err = fmt.Errorf("writing reduce output: %v", err)
+	}
+	finished <- err
 }
 
-func (task *ReduceTask) Process(tempdir string, client Interface) error {
+func (task *ReduceTask) Process(ctx context.Context, run *taskRun, client ContextInterface) error {
 	//jobs:
 	//1. create input database by merging all of the apporpiate output databases from the map phase
-	inputDB, err := mergeDatabases(task.SourceHosts, tempdir+reduceInputFile(task.N), tempdir+"temp.sqlite3")
+	inputDB, err := mergeDatabases(ctx, task.SourceHosts, run.dir+reduceInputFile(task.N), run.dir+reduceTempFile(task.N), run.address, run.counters)
+	if err != nil {
+		return err
+	}
 	defer inputDB.Close()
 
 	//2. create the output database
-	outputDB, err := createDatabase(tempdir + reduceOutputFile(task.N))
+	outputDB, err := createDatabase(run.dir + reduceOutputFile(task.N))
 	if err != nil {
-		return err
+		return fmt.Errorf("creating reduce output: %v", err)
 	}
 	defer outputDB.Close()
 
-	//3. process all pairs in the correct order. This is trickier than in the map phase Use this query:
-	rows, err := inputDB.Query("select key, value from pairs order by key, value")
+	//3. process all pairs in the correct order. This is trickier than in the map phase
+	grouping, err := task.Sort.grouping()
 	if err != nil {
 		return err
 	}
+	group := guard(grouping)
+	rows, release, err := querySorted(ctx, inputDB, task.Sort)
+	if err != nil {
+		return fmt.Errorf("reading reduce input: %v", err)
+	}
+	defer release()
 	defer rows.Close()
 
+	info := task.info(run)
+	ctx = context.WithValue(ctx, taskInfoKey{}, info)
+	teardown, err := setupTask(client, info)
+	if err != nil {
+		return fmt.Errorf("setting up reduce task: %v", err)
+	}
+	defer teardown()
+
 	var key string
 	var value string
 
+	// Values feeds the Reduce call for pKey. reduceDone is set if that call
+	// returned before reading all of its values, or if pKey is skipped.
+	skip := skipSet(task.Skip)
 	pKey := ""
-	Values := make(chan string)
-	Finished := make(chan error)
+	started := false
+	reduceDone := false
+	skipping := false
+	var Values chan string
+	var Finished chan error
+	finishKey := func() error {
+		if reduceDone {
+			return nil
+		}
+		close(Values)
+		return <-Finished
+	}
+
 	for rows.Next() {
+		if err = ctx.Err(); err != nil {
+			if started {
+				finishKey()
+			}
+			return err
+		}
 		err = rows.Scan(&key, &value)
 		if err != nil {
-			log.Printf("key error")
+			if started {
+				finishKey()
+			}
+			return fmt.Errorf("reading reduce input: %v", err)
 		}
 
-		if key != pKey && pKey != "" {
+		if !started || group.compare(key, pKey) != 0 {
+			if started {
+				if err = finishKey(); err != nil {
+					return err
+				}
+			}
+			started = true
 			pKey = key
-			close(Values)
-			err = <-Finished
+			skipping = skip[key]
+			reduceDone = skipping
+			if !skipping {
+				Values = make(chan string)
+				Finished = make(chan error, 1)
+				go launchReduceGoRoutines(ctx, Values, Finished, pKey, client, outputDB)
+			}
+		}
+		atomic.AddInt64(&run.counters.processed, 1)
+		if skipping {
+			atomic.AddInt64(&run.counters.skipped, 1)
+		}
+		if reduceDone {
+			continue
+		}
+		select {
+		case Values <- value:
+		case err = <-Finished:
+			reduceDone = true
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
-			close(Finished)
-			Values = make(chan string)
-			Finished = make(chan error)
-			go launchReduceGoRoutines(Values, Finished, pKey, client, outputDB)
-		} else if pKey == "" {
-			pKey = key
-			go launchReduceGoRoutines(Values, Finished, pKey, client, outputDB)
 		}
-		Values <- value
-
+	}
+	if started {
+		if err = finishKey(); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("reading reduce input: %v", err)
+	}
+	if err = release(); err != nil {
+		return fmt.Errorf("sorting reduce input: %v", err)
+	}
+	if err = group.err(); err != nil {
+		return fmt.Errorf("grouping reduce input: %v", err)
+	}
+	if err = teardown(); err != nil {
+		return fmt.Errorf("tearing down reduce task: %v", err)
 	}
 
 	return nil
 }
 
-func worker(address string, masterAddress string, notClient Interface) {
+// worker runs tasks for the master in the given number of slots at once,
+// until the master tells it to stop.
+func worker(address string, masterAddress string, notClient ContextInterface, slots int) {
 
 	tempdir := filepath.Join(os.TempDir(), fmt.Sprintf("mapreduce.%d", os.Getpid()))
-	os.Mkdir(tempdir, 755)
+	os.Mkdir(tempdir, 0755)
 	//tempdir := "data/"
+	http.Handle(tempdir+"/", http.StripPrefix(tempdir, http.FileServer(http.Dir(tempdir))))
+	srv := &http.Server{Addr: address}
 	go func() {
-		http.Handle(tempdir+"/", http.StripPrefix(tempdir, http.FileServer(http.Dir(tempdir))))
-		if err := http.ListenAndServe(address, nil); err != nil {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Printf("Error in HTTP server for %s: %v", address, err)
 		}
 	}()
 
-	for {
-		Task := dialGetTask(masterAddress)
+	master := newMasterConn(masterAddress)
+	defer master.close()
+	ws := &workerStatus{tempdir: tempdir, cancelled: make(map[int]bool)}
+	for i := 0; i < slots; i++ {
+		ws.slots = append(ws.slots, &taskStatus{taskID: -1})
+	}
+	quit := make(chan struct{})
+	go heartbeat(master, address, ws, quit)
+
+	var wg sync.WaitGroup
+	for _, status := range ws.slots {
+		wg.Add(1)
+		go func(status *taskStatus) {
+			defer wg.Done()
+			runSlot(master, address, slots, notClient, ws, status)
+		}(status)
+	}
+	wg.Wait()
+
+	log.Printf("master asked us to stop, cleaning up\n")
+	close(quit)
+	dialGoodbye(master, address)
+	closeServer(srv)
+	os.RemoveAll(tempdir)
+}
+
+// runSlot asks the master for tasks and runs them one after another, until
+// the master tells the worker to stop.
+func runSlot(master *masterConn, address string, slots int, notClient ContextInterface, ws *workerStatus, status *taskStatus) {
+	for !ws.isStopping() {
+		// blocks until the master has something for us, or times out
+		Task := dialGetTask(master, ws, address, slots)
+		ws.cancelJobs(Task.Cancelled)
 
 		if Task.Finished {
-			return
+			ws.stop()
+			break
+		}
+		if Task.MapTask == nil && Task.ReduceTask == nil {
+			continue
+		}
+
+		// each job's files go in their own directory
+		jobdir := ws.jobDir(Task.JobID)
+		if err := os.MkdirAll(jobdir, 0755); err != nil {
+			log.Printf("creating %s: %v", jobdir, err)
+			dialFailed(master, ws, Task, address, err)
+			continue
 		}
 
+		ctx, cancel := context.WithCancel(context.Background())
+		run := &taskRun{dir: jobdir, address: address, attempt: Task.Attempt, counters: &status.counters}
+		var err error
+		status.start(Task, cancel)
 		if Task.MapTask != nil {
 			log.Println("processing maptask")
-			Task.MapTask.Process(tempdir+"/", notClient)
-			dialFinished(masterAddress, Task.TaskID, address, tempdir+"/")
-
-		} else if Task.ReduceTask != nil {
+			err = Task.MapTask.Process(ctx, run, notClient)
+		} else {
 			log.Println("processing reducetask")
-			Task.ReduceTask.Process(tempdir+"/", notClient)
-			dialFinished(masterAddress, Task.TaskID, address, tempdir+"/")
+			err = Task.ReduceTask.Process(ctx, run, notClient)
+		}
+		status.stop()
+		revoked := ctx.Err() != nil
+		cancel()
+
+		if ws.isCancelled(Task.JobID) {
+			// the job's directory may have been removed while the task was
+			// still writing to it
+			log.Printf("job %d was cancelled, dropping task %d", Task.JobID, Task.TaskID)
+			os.RemoveAll(jobdir)
+			continue
+		}
+		if ws.isStopping() {
+			// the master is going away and won't want the result
+			log.Printf("stopping, dropping task %d of job %d", Task.TaskID, Task.JobID)
+			continue
+		}
+		if revoked {
+			log.Printf("task %d of job %d was revoked by the master", Task.TaskID, Task.JobID)
+			continue
+		}
+
+		if Task.MapTask != nil {
+			if err != nil {
+				log.Printf("map task %d failed: %v", Task.TaskID, err)
+				dialFailed(master, ws, Task, address, err)
+				continue
+			}
+			dialFinished(master, ws, Task, address, jobdir, run.counters)
+
 		} else {
-			log.Println("sleeping 1 second")
-			time.Sleep(1000 * time.Millisecond)
+			if fetchErr, ok := err.(*fetchError); ok {
+				dialFetchFailed(master, ws, Task, address, fetchErr.urls)
+				continue
+			}
+			if err != nil {
+				log.Printf("reduce task %d failed: %v", Task.TaskID, err)
+				dialFailed(master, ws, Task, address, err)
+				continue
+			}
+			dialFinished(master, ws, Task, address, jobdir, run.counters)
+		}
+	}
+}
+
+// start records that the worker has begun a task, which can be aborted with
+// cancel.
+func (status *taskStatus) start(Task *Task, cancel context.CancelFunc) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	atomic.StoreInt64(&status.job, int64(Task.JobID))
+	atomic.StoreInt64(&status.phase, int64(Task.phase()))
+	atomic.StoreInt64(&status.taskID, int64(Task.TaskID))
+	atomic.StoreInt64(&status.attempt, int64(Task.Attempt))
+	status.counters.reset()
+	status.cancel = cancel
+}
+
+// stop records that the worker has gone idle. The counters are kept until
+// the next task starts, so that they can be reported to the master.
+func (status *taskStatus) stop() {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	atomic.StoreInt64(&status.taskID, -1)
+	status.cancel = nil
+}
+
+// abortIf aborts the running task if match returns true for it.
+func (status *taskStatus) abortIf(match func(job, phase, taskID, attempt int) bool) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	if status.cancel == nil {
+		return
+	}
+	if match(int(status.job), int(status.phase), int(status.taskID), int(status.attempt)) {
+		status.cancel()
+	}
+}
+
+// jobDir returns the directory holding a job's files on the worker.
+func (ws *workerStatus) jobDir(id int) string {
+	return filepath.Join(ws.tempdir, strconv.Itoa(id)) + "/"
+}
+
+// stop makes the worker stop asking for tasks, and aborts the tasks it is
+// running.
+func (ws *workerStatus) stop() {
+	if atomic.SwapInt64(&ws.stopping, 1) != 0 {
+		return
+	}
+	for _, status := range ws.slots {
+		status.abortIf(func(job, phase, taskID, attempt int) bool {
+			return true
+		})
+	}
+}
+
+// isStopping reports whether the master has asked the worker to stop.
+func (ws *workerStatus) isStopping() bool {
+	return atomic.LoadInt64(&ws.stopping) != 0
+}
 
+// report sends a task's outcome to the master. Once the worker is stopping
+// the master may already be gone, so it is not waited for, and a failure is
+// only logged rather than fatal.
+func (ws *workerStatus) report(master *masterConn, method string, args interface{}) {
+	var err error
+	if ws.isStopping() {
+		err = master.try(method, args, new(Nothing))
+	} else {
+		err = master.call(method, args, new(Nothing))
+	}
+	if err == nil {
+		return
+	}
+	if ws.isStopping() {
+		log.Printf("%s: %v", method, err)
+		return
+	}
+	log.Fatalf("%s: %v", method, err)
+}
+
+// cancelJobs aborts the running tasks of jobs the master has cancelled, and
+// removes their files.
+func (ws *workerStatus) cancelJobs(ids []int) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for _, id := range ids {
+		if ws.cancelled[id] {
+			continue
+		}
+		ws.cancelled[id] = true
+		log.Printf("job %d cancelled, removing its files", id)
+		for _, status := range ws.slots {
+			status.abortIf(func(job, phase, taskID, attempt int) bool {
+				return job == id
+			})
 		}
+		os.RemoveAll(ws.jobDir(id))
 	}
-	log.Printf("cleaning up\n")
-	os.RemoveAll(tempdir)
-	os.Exit(0)
 }
 
-func dialFinished(masterAddress string, id int, address string, tempdir string) {
+// isCancelled reports whether the master has cancelled a job.
+func (ws *workerStatus) isCancelled(id int) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.cancelled[id]
+}
+
+// revoke aborts the given tasks if they are still running.
+func (ws *workerStatus) revoke(tasks []TaskProgress) {
+	for _, task := range tasks {
+		log.Printf("master revoked job %d task %d attempt %d", task.JobID, task.TaskID, task.Attempt)
+		for _, status := range ws.slots {
+			status.abortIf(func(job, phase, taskID, attempt int) bool {
+				return job == task.JobID && phase == task.Phase && taskID == task.TaskID && attempt == task.Attempt
+			})
+		}
+	}
+}
 
-	client, err := rpc.DialHTTP("tcp", masterAddress)
-	if err != nil {
-		log.Fatalf("rpc.DialHTTP: %v", err)
+// add counts n input bytes read, locally or from another host.
+func (c *taskCounters) add(n int64, local bool) {
+	if local {
+		atomic.AddInt64(&c.localBytes, n)
+	} else {
+		atomic.AddInt64(&c.remoteBytes, n)
 	}
-	var none Nothing
+}
+
+func (c *taskCounters) reset() {
+	atomic.StoreInt64(&c.processed, 0)
+	atomic.StoreInt64(&c.skipped, 0)
+	atomic.StoreInt64(&c.combineIn, 0)
+	atomic.StoreInt64(&c.combineOut, 0)
+	atomic.StoreInt64(&c.localBytes, 0)
+	atomic.StoreInt64(&c.remoteBytes, 0)
+}
+
+// report returns the counters as sent to the master in TaskFinInfo.
+func (c *taskCounters) report() map[string]int64 {
+	return map[string]int64{
+		"input pairs":       atomic.LoadInt64(&c.processed),
+		"skipped pairs":     atomic.LoadInt64(&c.skipped),
+		"combine input":     atomic.LoadInt64(&c.combineIn),
+		"combine output":    atomic.LoadInt64(&c.combineOut),
+		"local bytes read":  atomic.LoadInt64(&c.localBytes),
+		"remote bytes read": atomic.LoadInt64(&c.remoteBytes),
+	}
+}
+
+// phase returns 0 for a map task and 1 for a reduce task.
+func (Task *Task) phase() int {
+	if Task.ReduceTask != nil {
+		return 1
+	}
+	return 0
+}
+
+func dialFinished(master *masterConn, ws *workerStatus, Task *Task, address string, tempdir string, counters *taskCounters) {
+
 	var TaskFinInfo TaskFinInfo
-	TaskFinInfo.TaskID = id
+	TaskFinInfo.JobID = Task.JobID
+	TaskFinInfo.TaskID = Task.TaskID
+	TaskFinInfo.Phase = Task.phase()
+	TaskFinInfo.Attempt = Task.Attempt
 	TaskFinInfo.Address = address
 	TaskFinInfo.SourceHost = address
 	TaskFinInfo.Directory = tempdir
-	err = client.Call("Work.FinishedTask", TaskFinInfo, &none)
+	TaskFinInfo.Counters = counters.report()
+	ws.report(master, "Work.FinishedTask", TaskFinInfo)
+}
+
+func dialFailed(master *masterConn, ws *workerStatus, Task *Task, address string, taskErr error) {
+
+	var failure TaskFailure
+	failure.JobID = Task.JobID
+	failure.TaskID = Task.TaskID
+	failure.Phase = Task.phase()
+	failure.Attempt = Task.Attempt
+	failure.Address = address
+	failure.Error = taskErr.Error()
+	if keyErr, ok := taskErr.(*keyError); ok {
+		failure.Key = keyErr.key
+		failure.BadKey = true
+	}
+	ws.report(master, "Work.FailedTask", failure)
+}
+
+func dialFetchFailed(master *masterConn, ws *workerStatus, Task *Task, address string, urls []string) {
+
+	var failure FetchFailure
+	failure.JobID = Task.JobID
+	failure.TaskID = Task.TaskID
+	failure.Address = address
+	failure.URLs = urls
+	ws.report(master, "Work.FetchFailed", failure)
+}
+
+func dialGetTask(master *masterConn, ws *workerStatus, address string, slots int) *Task {
+
+	var req TaskRequest
+	req.Address = address
+	req.Slots = slots
+	var next *Task
+	err := master.call("Work.GetTask", req, &next)
+	if err != nil && ws.isStopping() {
+		// the master has shut down after telling the heartbeat to stop
+		log.Printf("Work.GetTask: %v", err)
+		return &Task{Finished: true}
+	}
 	if err != nil {
-		log.Fatalf("Work.FinishedTask: %v", err)
+		log.Fatalf("Work.GetTask: %v", err)
 	}
+	return next
+
+}
 
-	if err = client.Close(); err != nil {
-		log.Fatalf("error closing the client connection: %v", err)
+// dialGoodbye tells the master the worker is exiting. The master may
+// already be gone, so failures are only logged.
+func dialGoodbye(master *masterConn, address string) {
+	if err := master.try("Work.Goodbye", RegisterArgs{Address: address}, new(Nothing)); err != nil {
+		log.Printf("Work.Goodbye: %v", err)
 	}
 }
 
-func dialGetTask(masterAddress string) *Task {
+// shutdown asks a running master to stop itself and its workers.
+func shutdown(masterAddress string) error {
+	client, err := rpc.DialHTTP("tcp", masterAddress)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Call("Work.Shutdown", Nothing{}, new(Nothing))
+}
 
+// submit sends a job to a running master and returns the ID it was given.
+func submit(masterAddress string, spec JobSpec) (int, error) {
 	client, err := rpc.DialHTTP("tcp", masterAddress)
 	if err != nil {
-		log.Fatalf("rpc.DialHTTP: %v", err)
+		return 0, err
 	}
-	var none Nothing
-	var Task *Task
-	err = client.Call("Work.GetTask", none, &Task)
+	defer client.Close()
+
+	var id int
+	err = client.Call("Work.SubmitJob", spec, &id)
+	return id, err
+}
+
+// getStatus asks a running master what it is doing.
+func getStatus(masterAddress string) (StatusReply, error) {
+	var status StatusReply
+	client, err := rpc.DialHTTP("tcp", masterAddress)
 	if err != nil {
-		log.Fatalf("Work.GetTask: %v", err)
+		return status, err
 	}
+	defer client.Close()
+
+	err = client.Call("Work.Status", Nothing{}, &status)
+	return status, err
+}
 
-	if err = client.Close(); err != nil {
-		log.Fatalf("error closing the client connection: %v", err)
+// clearBlacklist asks a running master to take a worker, or every worker if
+// the address is empty, off its blacklist. It returns how many were cleared.
+func clearBlacklist(masterAddress string, address string) (int, error) {
+	client, err := rpc.DialHTTP("tcp", masterAddress)
+	if err != nil {
+		return 0, err
 	}
-	return Task
+	defer client.Close()
+
+	var cleared int
+	err = client.Call("Work.ClearBlacklist", ClearArgs{Address: address}, &cleared)
+	return cleared, err
+}
 
+// cancelJob asks a running master to cancel a job.
+func cancelJob(masterAddress string, id int) error {
+	client, err := rpc.DialHTTP("tcp", masterAddress)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Call("Work.CancelJob", id, new(Nothing))
 }